@@ -0,0 +1,91 @@
+package elasticsearch
+
+import (
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/components/null"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/tsdb"
+	"github.com/grafana/grafana/pkg/tsdb/elasticsearch/client"
+)
+
+// ParseAnnotations turns the documents of an annotations search response into
+// a table with one annotation per row. The time, text and tags fields may be
+// dotted paths into _source. Documents without a time are skipped.
+func ParseAnnotations(response *es.SearchResponse, timeField, textField, tagsField string) *tsdb.QueryResult {
+	table := &tsdb.Table{
+		Columns: []tsdb.TableColumn{{Text: "time"}, {Text: "text"}, {Text: "tags"}},
+		Rows:    make([]tsdb.RowValues, 0),
+	}
+
+	if response.Hits != nil {
+		for _, h := range response.Hits.Hits {
+			hit := simplejson.NewFromAny(h)
+			source := hit.Get("_source")
+
+			t := getAnnotationTime(hit, source, timeField)
+			if !t.Valid {
+				continue
+			}
+
+			text := ""
+			if textField != "" {
+				text, _ = getSourceField(source, textField).String()
+			}
+
+			table.Rows = append(table.Rows, tsdb.RowValues{t, text, getAnnotationTags(getSourceField(source, tagsField))})
+		}
+	}
+
+	queryRes := tsdb.NewQueryResult()
+	queryRes.Tables = append(queryRes.Tables, table)
+	return queryRes
+}
+
+// getSourceField returns the value of a dotted field path in a document
+// _source.
+func getSourceField(source *simplejson.Json, field string) *simplejson.Json {
+	return source.GetPath(strings.Split(field, ".")...)
+}
+
+// getAnnotationTime returns the time of an annotation document in epoch
+// milliseconds, preferring doc value fields over _source. Returns null if the
+// document has no parsable time.
+func getAnnotationTime(hit, source *simplejson.Json, timeField string) null.Float {
+	value := getSourceField(source, timeField)
+	if values := hit.GetPath("fields", timeField).MustArray(); len(values) > 0 {
+		value = simplejson.NewFromAny(values[0])
+	}
+
+	if s, err := value.String(); err == nil {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return null.FloatFrom(float64(t.UnixNano() / int64(time.Millisecond)))
+		}
+	}
+
+	return castToNullFloat(value)
+}
+
+// getAnnotationTags returns the tags of an annotation document. Array values
+// are kept as a list and string values are split on commas.
+func getAnnotationTags(value *simplejson.Json) []string {
+	tags := make([]string, 0)
+
+	if values, err := value.Array(); err == nil {
+		for _, v := range values {
+			if tag, err := simplejson.NewFromAny(v).String(); err == nil {
+				tags = append(tags, tag)
+			}
+		}
+		return tags
+	}
+
+	if s, err := value.String(); err == nil && s != "" {
+		for _, tag := range strings.Split(s, ",") {
+			tags = append(tags, strings.TrimSpace(tag))
+		}
+	}
+
+	return tags
+}
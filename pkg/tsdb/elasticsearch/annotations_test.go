@@ -0,0 +1,109 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/components/null"
+	"github.com/grafana/grafana/pkg/tsdb"
+	"github.com/grafana/grafana/pkg/tsdb/elasticsearch/client"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAnnotationParser(t *testing.T) {
+	Convey("Elasticsearch annotation parser test", t, func() {
+		Convey("Simple annotation documents", func() {
+			response := `{
+				"hits": {
+					"hits": [
+						{
+							"_source": {
+								"@timestamp": 1000,
+								"message": "deploy",
+								"tags": ["prod", "api"]
+							}
+						},
+						{
+							"_source": {
+								"@timestamp": "2018-05-15T17:50:00Z",
+								"message": "restart",
+								"tags": "prod, db"
+							}
+						}
+					]
+				}
+			}`
+			queryRes, err := parseAnnotationsForTest(response, "@timestamp", "message", "tags")
+			So(err, ShouldBeNil)
+			So(queryRes.Tables, ShouldHaveLength, 1)
+
+			table := queryRes.Tables[0]
+			So(table.Columns, ShouldHaveLength, 3)
+			So(table.Columns[0].Text, ShouldEqual, "time")
+			So(table.Columns[1].Text, ShouldEqual, "text")
+			So(table.Columns[2].Text, ShouldEqual, "tags")
+			So(table.Rows, ShouldHaveLength, 2)
+
+			So(table.Rows[0][0], ShouldResemble, null.FloatFrom(1000))
+			So(table.Rows[0][1], ShouldEqual, "deploy")
+			So(table.Rows[0][2], ShouldResemble, []string{"prod", "api"})
+
+			So(table.Rows[1][0], ShouldResemble, null.FloatFrom(1526406600000))
+			So(table.Rows[1][1], ShouldEqual, "restart")
+			So(table.Rows[1][2], ShouldResemble, []string{"prod", "db"})
+		})
+
+		Convey("Nested fields and doc value time", func() {
+			response := `{
+				"hits": {
+					"hits": [
+						{
+							"_source": {
+								"event": { "text": "nested", "labels": ["a"] }
+							},
+							"fields": { "@timestamp": [2000] }
+						}
+					]
+				}
+			}`
+			queryRes, err := parseAnnotationsForTest(response, "@timestamp", "event.text", "event.labels")
+			So(err, ShouldBeNil)
+
+			rows := queryRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 1)
+			So(rows[0][0], ShouldResemble, null.FloatFrom(2000))
+			So(rows[0][1], ShouldEqual, "nested")
+			So(rows[0][2], ShouldResemble, []string{"a"})
+		})
+
+		Convey("Documents missing the time field are skipped", func() {
+			response := `{
+				"hits": {
+					"hits": [
+						{ "_source": { "message": "no time" } },
+						{ "_source": { "@timestamp": "not a date", "message": "bad time" } },
+						{ "_source": { "@timestamp": 3000 } }
+					]
+				}
+			}`
+			queryRes, err := parseAnnotationsForTest(response, "@timestamp", "message", "tags")
+			So(err, ShouldBeNil)
+
+			rows := queryRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 1)
+			So(rows[0][0], ShouldResemble, null.FloatFrom(3000))
+			So(rows[0][1], ShouldEqual, "")
+			So(rows[0][2], ShouldResemble, []string{})
+		})
+	})
+}
+
+func parseAnnotationsForTest(responseBody, timeField, textField, tagsField string) (*tsdb.QueryResult, error) {
+	var response es.SearchResponse
+	if err := json.Unmarshal([]byte(responseBody), &response); err != nil {
+		return nil, err
+	}
+
+	return ParseAnnotations(&response, timeField, textField, tagsField), nil
+}
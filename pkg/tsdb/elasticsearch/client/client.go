@@ -227,8 +227,15 @@ func (c *baseClientImpl) ExecuteMultisearch(r *MultiSearchRequest) (*MultiSearch
 	start := time.Now()
 	clientLog.Debug("Decoding multisearch json response")
 
+	// Elasticsearch compatible backends may return the aggregations under
+	// another top-level field of each response
+	aggregationsKey := c.getSettings().Get("aggregationsKey").MustString()
+	if aggregationsKey == "aggregations" {
+		aggregationsKey = ""
+	}
+
 	var bodyBytes []byte
-	if c.debugEnabled {
+	if c.debugEnabled || aggregationsKey != "" {
 		tmpBytes, err := ioutil.ReadAll(res.Body)
 		if err != nil {
 			clientLog.Error("failed to read http response bytes", "error", err)
@@ -251,6 +258,12 @@ func (c *baseClientImpl) ExecuteMultisearch(r *MultiSearchRequest) (*MultiSearch
 
 	msr.Status = res.StatusCode
 
+	if aggregationsKey != "" {
+		if err := resolveAggregations(&msr, bodyBytes, aggregationsKey); err != nil {
+			return nil, err
+		}
+	}
+
 	if c.debugEnabled {
 		bodyJSON, err := simplejson.NewFromReader(bytes.NewBuffer(bodyBytes))
 		var data *simplejson.Json
@@ -272,6 +285,32 @@ func (c *baseClientImpl) ExecuteMultisearch(r *MultiSearchRequest) (*MultiSearch
 	return &msr, nil
 }
 
+// resolveAggregations replaces the aggregations of the responses of a multi
+// search with the ones read from the given top-level field of each response
+// body. Responses missing the field are left without aggregations.
+func resolveAggregations(msr *MultiSearchResponse, body []byte, key string) error {
+	var raw struct {
+		Responses []map[string]json.RawMessage `json:"responses"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return err
+	}
+
+	for i, res := range msr.Responses {
+		res.Aggregations = nil
+		if i >= len(raw.Responses) {
+			continue
+		}
+		if aggs, ok := raw.Responses[i][key]; ok {
+			if err := json.Unmarshal(aggs, &res.Aggregations); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func (c *baseClientImpl) createMultiSearchRequests(searchRequests []*SearchRequest) []*multiRequest {
 	multiRequests := []*multiRequest{}
 
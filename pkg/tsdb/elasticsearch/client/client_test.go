@@ -365,6 +365,45 @@ func TestClient(t *testing.T) {
 				})
 			})
 		})
+
+		httpClientScenario(t, "Given a fake http client and a client with a custom aggregations key", &models.DataSource{
+			Database: "[metrics-]YYYY.MM.DD",
+			JsonData: simplejson.NewFromAny(map[string]interface{}{
+				"esVersion":       70,
+				"timeField":       "@timestamp",
+				"interval":        "Daily",
+				"aggregationsKey": "aggs",
+			}),
+		}, func(sc *scenarioContext) {
+			sc.responseBody = `{
+				"responses": [
+					{
+						"took": 3,
+						"aggs": { "2": { "buckets": [{ "doc_count": 10, "key": 1000 }] } }
+					},
+					{
+						"aggregations": { "2": { "buckets": [{ "doc_count": 10, "key": 1000 }] } }
+					}
+				]
+			}`
+
+			Convey("When executing multi search", func() {
+				ms, err := createMultisearchForTest(sc.client)
+				So(err, ShouldBeNil)
+				res, err := sc.client.ExecuteMultisearch(ms)
+				So(err, ShouldBeNil)
+
+				Convey("Should read the aggregations from the configured key", func() {
+					So(res.Responses, ShouldHaveLength, 2)
+					aggs := simplejson.NewFromAny(res.Responses[0].Aggregations)
+					So(aggs.GetPath("2", "buckets").MustArray(), ShouldHaveLength, 1)
+				})
+
+				Convey("Should leave responses missing the key without aggregations", func() {
+					So(res.Responses[1].Aggregations, ShouldBeNil)
+				})
+			})
+		})
 	})
 }
 
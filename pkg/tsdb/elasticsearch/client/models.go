@@ -65,7 +65,8 @@ func (r *SearchRequest) MarshalJSON() ([]byte, error) {
 
 // SearchResponseHits represents search response hits
 type SearchResponseHits struct {
-	Hits []map[string]interface{}
+	Hits  []map[string]interface{}
+	Total interface{} `json:"total"`
 }
 
 // SearchResponse represents a search response
@@ -73,6 +74,7 @@ type SearchResponse struct {
 	Error        map[string]interface{} `json:"error"`
 	Aggregations map[string]interface{} `json:"aggregations"`
 	Hits         *SearchResponseHits    `json:"hits"`
+	Profile      map[string]interface{} `json:"profile"`
 }
 
 // MultiSearchRequest represents a multi search request
@@ -250,6 +252,7 @@ type DateHistogramAgg struct {
 	ExtendedBounds *ExtendedBounds `json:"extended_bounds"`
 	Format         string          `json:"format"`
 	Offset         string          `json:"offset,omitempty"`
+	TimeZone       string          `json:"time_zone,omitempty"`
 }
 
 // FiltersAggregation represents a filters aggregation
@@ -259,11 +262,15 @@ type FiltersAggregation struct {
 
 // TermsAggregation represents a terms aggregation
 type TermsAggregation struct {
-	Field       string                 `json:"field"`
-	Size        int                    `json:"size"`
-	Order       map[string]interface{} `json:"order"`
-	MinDocCount *int                   `json:"min_doc_count,omitempty"`
-	Missing     *string                `json:"missing,omitempty"`
+	Field         string                 `json:"field"`
+	Size          int                    `json:"size"`
+	Order         map[string]interface{} `json:"order"`
+	MinDocCount   *int                   `json:"min_doc_count,omitempty"`
+	Missing       *string                `json:"missing,omitempty"`
+	Include       interface{}            `json:"include,omitempty"`
+	Exclude       interface{}            `json:"exclude,omitempty"`
+	ExecutionHint string                 `json:"execution_hint,omitempty"`
+	CollectMode   string                 `json:"collect_mode,omitempty"`
 }
 
 // ExtendedBounds represents extended bounds
@@ -102,6 +102,12 @@ func (b *SearchRequestBuilder) AddDocValueField(field string) *SearchRequestBuil
 	return b
 }
 
+// Profile enables profiling of the search request
+func (b *SearchRequestBuilder) Profile() *SearchRequestBuilder {
+	b.customProps["profile"] = true
+	return b
+}
+
 // Query creates and return a query builder
 func (b *SearchRequestBuilder) Query() *QueryBuilder {
 	if b.queryBuilder == nil {
@@ -45,5 +45,6 @@ func (e *ElasticsearchExecutor) Query(ctx context.Context, dsInfo *models.DataSo
 	}
 
 	query := newTimeSeriesQuery(client, tsdbQuery, intervalCalculator)
+	query.failFast = dsInfo.JsonData.Get("failFast").MustBool(false)
 	return query.execute()
 }
@@ -0,0 +1,49 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/grafana/grafana/pkg/tsdb"
+)
+
+// writeNDJSON writes the series and tables of a query result as newline
+// delimited JSON for export. Each series point becomes an object with the
+// series name, time, value and the series tags flattened as fields, and each
+// table row becomes an object keyed by column name.
+func writeNDJSON(w io.Writer, queryRes *tsdb.QueryResult) error {
+	enc := json.NewEncoder(w)
+
+	for _, series := range queryRes.Series {
+		for _, point := range series.Points {
+			row := make(map[string]interface{}, len(series.Tags)+3)
+			for k, v := range series.Tags {
+				row[k] = v
+			}
+			row["name"] = series.Name
+			row["time"] = point[1]
+			row["value"] = point[0]
+
+			if err := enc.Encode(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, table := range queryRes.Tables {
+		for _, values := range table.Rows {
+			row := make(map[string]interface{}, len(table.Columns))
+			for i, column := range table.Columns {
+				if i < len(values) {
+					row[column.Text] = values[i]
+				}
+			}
+
+			if err := enc.Encode(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
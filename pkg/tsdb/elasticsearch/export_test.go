@@ -0,0 +1,82 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExport(t *testing.T) {
+	Convey("Elasticsearch NDJSON export test", t, func() {
+		Convey("Count series", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+				"responses": [{
+					"aggregations": {
+						"2": {
+							"buckets": [{
+								"3": { "buckets": [{ "doc_count": 1, "key": 1000 }, { "doc_count": 3, "key": 2000 }] },
+								"doc_count": 4,
+								"key": "server1"
+							}]
+						}
+					}
+				}]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			var buf bytes.Buffer
+			err = writeNDJSON(&buf, result.Results["A"])
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldEqual,
+				`{"host":"server1","name":"server1","time":1000,"value":1}`+"\n"+
+					`{"host":"server1","name":"server1","time":2000,"value":3}`+"\n")
+		})
+
+		Convey("Terms table", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }, { "type": "avg", "field": "load", "id": "3" }],
+					"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+				}`,
+			}
+			response := `{
+				"responses": [{
+					"aggregations": {
+						"2": {
+							"buckets": [
+								{ "3": { "value": 1.5 }, "doc_count": 2, "key": "server1" },
+								{ "3": { "value": null }, "doc_count": 1, "key": "server2" }
+							]
+						}
+					}
+				}]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			var buf bytes.Buffer
+			err = writeNDJSON(&buf, result.Results["A"])
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldEqual,
+				`{"Average":1.5,"Count":2,"host":"server1"}`+"\n"+
+					`{"Average":null,"Count":1,"host":"server2"}`+"\n")
+		})
+	})
+}
@@ -6,13 +6,31 @@ import (
 
 // Query represents the time series query model of the datasource
 type Query struct {
-	TimeField  string       `json:"timeField"`
-	RawQuery   string       `json:"query"`
-	BucketAggs []*BucketAgg `json:"bucketAggs"`
-	Metrics    []*MetricAgg `json:"metrics"`
-	Alias      string       `json:"alias"`
-	Interval   string
-	RefID      string
+	TimeField          string       `json:"timeField"`
+	RawQuery           string       `json:"query"`
+	BucketAggs         []*BucketAgg `json:"bucketAggs"`
+	Metrics            []*MetricAgg `json:"metrics"`
+	Alias              string       `json:"alias"`
+	Output             string       `json:"output"`
+	RawBuckets         bool         `json:"rawBuckets"`
+	MissingCountAs     string       `json:"missingCountAs"`
+	Profile            bool         `json:"profile"`
+	DropAllNullSeries  bool         `json:"dropAllNullSeries"`
+	TimeColumn         string       `json:"timeColumn"`
+	StrictTermAccuracy bool         `json:"strictTermAccuracy"`
+	MaxDocCountError   int64        `json:"maxDocCountError"`
+	SplitByIndex       bool         `json:"splitByIndex"`
+	AlignInterval      string       `json:"alignInterval"`
+	SignificantDigits  int          `json:"significantDigits"`
+	TimeOrder          string       `json:"timeOrder"`
+	ColumnsMetric      string       `json:"columnsMetric"`
+	MaxRows            int          `json:"maxRows"`
+	MaxSeries          int          `json:"maxSeries"`
+	LenientParsing     bool         `json:"lenientParsing"`
+	CoalesceSeries     string       `json:"coalesceSeries"`
+	TotalSeries        bool         `json:"totalSeries"`
+	Interval           string
+	RefID              string
 }
 
 // BucketAgg represents a bucket aggregation of the time series query model of the datasource
@@ -36,18 +54,24 @@ type MetricAgg struct {
 }
 
 var metricAggType = map[string]string{
-	"count":          "Count",
-	"avg":            "Average",
-	"sum":            "Sum",
-	"max":            "Max",
-	"min":            "Min",
-	"extended_stats": "Extended Stats",
-	"percentiles":    "Percentiles",
-	"cardinality":    "Unique Count",
-	"moving_avg":     "Moving Average",
-	"derivative":     "Derivative",
-	"bucket_script":  "Bucket Script",
-	"raw_document":   "Raw Document",
+	"count":           "Count",
+	"avg":             "Average",
+	"sum":             "Sum",
+	"max":             "Max",
+	"min":             "Min",
+	"extended_stats":  "Extended Stats",
+	"percentiles":     "Percentiles",
+	"cardinality":     "Unique Count",
+	"moving_avg":      "Moving Average",
+	"derivative":      "Derivative",
+	"bucket_script":   "Bucket Script",
+	"bucket_selector": "Bucket Selector",
+	"raw_document":    "Raw Document",
+	"boxplot":         "Boxplot",
+	"t_test":          "T-Test",
+	"stats":           "Stats",
+	"matrix_stats":    "Matrix Stats",
+	"weighted_avg":    "Weighted Average",
 }
 
 var extendedStats = map[string]string{
@@ -59,16 +83,50 @@ var extendedStats = map[string]string{
 	"std_deviation":              "Std Dev",
 	"std_deviation_bounds_upper": "Std Dev Upper",
 	"std_deviation_bounds_lower": "Std Dev Lower",
+	"std_deviation_population":   "Std Dev Population",
+	"std_deviation_sampling":     "Std Dev Sampling",
+}
+
+// statsStats are the values returned by the stats aggregation
+var statsStats = []string{"avg", "count", "max", "min", "sum"}
+
+var boxplotStats = map[string]string{
+	"min":   "Min",
+	"lower": "Lower Whisker",
+	"q1":    "Q1",
+	"q2":    "Median",
+	"q3":    "Q3",
+	"upper": "Upper Whisker",
+	"max":   "Max",
+}
+
+// boxplotStatOrder is the order in which boxplot stats are returned
+var boxplotStatOrder = []string{"min", "lower", "q1", "q2", "q3", "upper", "max"}
+
+// defaultPercents are the percents Elasticsearch computes when a percentiles
+// aggregation has none configured
+var defaultPercents = []interface{}{1, 5, 25, 50, 75, 95, 99}
+
+// matrixStatsSeries are the per field stats of a matrix_stats aggregation
+// returned as time series
+var matrixStatsSeries = []string{"mean", "variance"}
+
+var matrixStats = map[string]string{
+	"count":    "Count",
+	"mean":     "Mean",
+	"variance": "Variance",
 }
 
 var pipelineAggType = map[string]string{
-	"moving_avg":    "moving_avg",
-	"derivative":    "derivative",
-	"bucket_script": "bucket_script",
+	"moving_avg":      "moving_avg",
+	"derivative":      "derivative",
+	"bucket_script":   "bucket_script",
+	"bucket_selector": "bucket_selector",
 }
 
 var pipelineAggWithMultipleBucketPathsType = map[string]string{
-	"bucket_script": "bucket_script",
+	"bucket_script":   "bucket_script",
+	"bucket_selector": "bucket_selector",
 }
 
 func isPipelineAgg(metricType string) bool {
@@ -1,12 +1,17 @@
 package elasticsearch
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"math"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/grafana/grafana/pkg/components/gtime"
 	"github.com/grafana/grafana/pkg/components/null"
 	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/tsdb"
@@ -15,28 +20,83 @@ import (
 
 const (
 	// Metric types
-	countType         = "count"
-	percentilesType   = "percentiles"
-	extendedStatsType = "extended_stats"
+	countType          = "count"
+	sumType            = "sum"
+	minType            = "min"
+	maxType            = "max"
+	valueCountType     = "value_count"
+	percentilesType    = "percentiles"
+	extendedStatsType  = "extended_stats"
+	topHitsType        = "top_hits"
+	cardinalityType    = "cardinality"
+	geoLineType        = "geo_line"
+	boxplotType        = "boxplot"
+	statsType          = "stats"
+	bucketSelectorType = "bucket_selector"
+	matrixStatsType    = "matrix_stats"
+	weightedAvgType    = "weighted_avg"
 	// Bucket types
-	dateHistType    = "date_histogram"
-	histogramType   = "histogram"
-	filtersType     = "filters"
-	termsType       = "terms"
-	geohashGridType = "geohash_grid"
+	dateHistType           = "date_histogram"
+	histogramType          = "histogram"
+	filtersType            = "filters"
+	termsType              = "terms"
+	geohashGridType        = "geohash_grid"
+	geotileGridType        = "geotile_grid"
+	ipRangeType            = "ip_range"
+	rareTermsType          = "rare_terms"
+	samplerType            = "sampler"
+	diversifiedSamplerType = "diversified_sampler"
+	compositeType          = "composite"
+	// Bucket aggregation splitting targets by index
+	indexAggID = "index"
+	indexField = "_index"
+	// Output modes
+	wideOutput           = "wide"
+	heatmapOutput        = "heatmap"
+	columnsPerTermOutput = "columnsPerTerm"
+	// Time orders
+	timeOrderDesc = "desc"
+	// Default label of null composite source values
+	defaultCompositeMissingLabel = "(missing)"
+	// Missing count modes
+	missingCountNull = "null"
+	missingCountZero = "zero"
+	// Series coalescing modes
+	coalesceSum  = "sum"
+	coalesceKeep = "keep"
+	// Term value of the series summing a metric across all terms
+	totalTerm = "Total"
+	// Metric value types
+	valueTypeString = "string"
+	// Default name of the time column of tables built from time series
+	defaultTimeColumn = "Time"
+	// Maximum size in bytes of a raw bucket attached to the result
+	maxRawBucketSize = 4096
+	// Default maximum nesting depth of bucket aggregations
+	defaultMaxDepth = 10
+	// Number of slowest shards and queries kept in a profile summary
+	maxProfileEntries = 3
 )
 
 type responseParser struct {
 	Responses []*es.SearchResponse
 	Targets   []*Query
 	DebugInfo *es.SearchDebugInfo
+	// FailFast makes the parser return the first error response or parse
+	// error as an error instead of recording an error result per target.
+	FailFast bool
+	// MaxDepth is the maximum nesting depth of bucket aggregations the parser
+	// processes before returning an error.
+	MaxDepth int
 }
 
-var newResponseParser = func(responses []*es.SearchResponse, targets []*Query, debugInfo *es.SearchDebugInfo) *responseParser {
+var newResponseParser = func(responses []*es.SearchResponse, targets []*Query, debugInfo *es.SearchDebugInfo, failFast bool) *responseParser {
 	return &responseParser{
 		Responses: responses,
 		Targets:   targets,
 		DebugInfo: debugInfo,
+		FailFast:  failFast,
+		MaxDepth:  defaultMaxDepth,
 	}
 }
 
@@ -48,8 +108,18 @@ func (rp *responseParser) getTimeSeries() (*tsdb.Response, error) {
 		return result, nil
 	}
 
-	for i, res := range rp.Responses {
-		target := rp.Targets[i]
+	for _, target := range rp.Targets {
+		if err := validateBucketAggIDs(target); err != nil {
+			return nil, err
+		}
+	}
+
+	responses, targets, unmerged := rp.mergeResponses()
+	for i, res := range responses {
+		target := targets[i]
+		if target.Output == columnsPerTermOutput {
+			target = getColumnsPerTermTarget(target)
+		}
 
 		var debugInfo *simplejson.Json
 		if rp.DebugInfo != nil && i == 0 {
@@ -57,24 +127,87 @@ func (rp *responseParser) getTimeSeries() (*tsdb.Response, error) {
 		}
 
 		if res.Error != nil {
+			if rp.FailFast {
+				return nil, errors.New(getErrorFromElasticResponse(res).ErrorString)
+			}
 			result.Results[target.RefID] = getErrorFromElasticResponse(res)
 			result.Results[target.RefID].Meta = debugInfo
 			continue
 		}
 
+		if target.MaxSeries > 0 {
+			if count := rp.estimateSeriesCount(target, res); count > target.MaxSeries {
+				result.Results[target.RefID] = tsdb.NewQueryResult()
+				result.Results[target.RefID].ErrorString = fmt.Sprintf("the response has about %d series, more than the limit of %d", count, target.MaxSeries)
+				result.Results[target.RefID].Meta = debugInfo
+				continue
+			}
+		}
+
 		queryRes := tsdb.NewQueryResult()
 		queryRes.Meta = debugInfo
+		if target.Profile && res.Profile != nil {
+			getQueryResultMeta(queryRes).Set("profile", summarizeProfile(simplejson.NewFromAny(res.Profile)))
+		}
+		if unmerged[i] {
+			addMetaNotice(queryRes, "some metrics can't be combined across searches and were left empty")
+		}
+		addPercentilesMethodMeta(queryRes, target)
+		addMissingValueMeta(queryRes, target)
+		addWeightedAvgMissingMeta(queryRes, target)
+		addBucketSelectorMeta(queryRes, target)
+		if res.Hits != nil && res.Hits.Total != nil {
+			addHitsTotalMeta(queryRes, simplejson.NewFromAny(res.Hits.Total))
+		}
 		props := make(map[string]string)
+		propValues := make(map[string]interface{})
 		table := tsdb.Table{
 			Columns: make([]tsdb.TableColumn, 0),
 			Rows:    make([]tsdb.RowValues, 0),
 		}
-		err := rp.processBuckets(res.Aggregations, target, &queryRes.Series, &table, props, 0)
+		err := rp.processBuckets(res.Aggregations, target, queryRes, &table, props, propValues, 0)
 		if err != nil {
-			return nil, err
+			if rp.FailFast {
+				return nil, err
+			}
+			// lenient parsing keeps what was parsed before the error, unless the
+			// structure of the response is broken
+			if _, structural := err.(*structuralError); !target.LenientParsing || structural {
+				// errors caused by the settings or the response of a target only fail the target
+				result.Results[target.RefID] = tsdb.NewQueryResult()
+				result.Results[target.RefID].ErrorString = err.Error()
+				result.Results[target.RefID].Meta = debugInfo
+				continue
+			}
+			addMetaNotice(queryRes, "parsing stopped early: "+err.Error())
 		}
+		rp.coalesceSeries(&queryRes.Series, target)
+		rp.fillMissingCounts(&queryRes.Series, target)
+		rp.trimZeroCounts(&queryRes.Series, target)
+		rp.addTotalSeries(&queryRes.Series, target)
 		rp.nameSeries(&queryRes.Series, target)
-		rp.trimDatapoints(&queryRes.Series, target)
+		if !rp.trimDatapoints(&queryRes.Series, target) {
+			addMetaNotice(queryRes, "trimEdges is too large for the returned data size, some series were not trimmed")
+		}
+		addEffectiveTimeRangeMeta(queryRes)
+
+		if (target.Output == wideOutput || target.Output == columnsPerTermOutput) && len(queryRes.Series) > 0 {
+			wideTable := rp.toWideTable(queryRes.Series, getTimeColumn(target))
+			if target.TimeOrder == timeOrderDesc {
+				for i, j := 0, len(wideTable.Rows)-1; i < j; i, j = i+1, j-1 {
+					wideTable.Rows[i], wideTable.Rows[j] = wideTable.Rows[j], wideTable.Rows[i]
+				}
+			}
+			queryRes.Tables = append(queryRes.Tables, wideTable)
+			queryRes.Series = make(tsdb.TimeSeriesSlice, 0)
+		} else if target.TimeOrder == timeOrderDesc {
+			for _, series := range queryRes.Series {
+				points := series.Points
+				for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+					points[i], points[j] = points[j], points[i]
+				}
+			}
+		}
 
 		if len(table.Rows) > 0 {
 			queryRes.Tables = append(queryRes.Tables, &table)
@@ -85,10 +218,243 @@ func (rp *responseParser) getTimeSeries() (*tsdb.Response, error) {
 	return result, nil
 }
 
-func (rp *responseParser) processBuckets(aggs map[string]interface{}, target *Query, series *tsdb.TimeSeriesSlice, table *tsdb.Table, props map[string]string, depth int) error {
+// getColumnsPerTermTarget returns a copy of the target showing only the metric
+// the columns of the columnsPerTerm output are built from: the metric set by
+// ColumnsMetric, shown even if hidden, or else the first visible metric. The
+// other metrics are hidden rather than removed so pipeline metrics referencing
+// them are still named.
+func getColumnsPerTermTarget(target *Query) *Query {
+	columnsTarget := *target
+	columnsTarget.Metrics = make([]*MetricAgg, 0, len(target.Metrics))
+
+	found := false
+	for _, metric := range target.Metrics {
+		columnsMetric := *metric
+		if !found && (metric.ID == target.ColumnsMetric || (target.ColumnsMetric == "" && !metric.Hide)) {
+			columnsMetric.Hide = false
+			found = true
+		} else {
+			columnsMetric.Hide = true
+		}
+		columnsTarget.Metrics = append(columnsTarget.Metrics, &columnsMetric)
+	}
+
+	return &columnsTarget
+}
+
+// mergeResponses merges the responses of targets sharing the same ref id, as
+// when a single target is split into several searches. Buckets with the same
+// key are combined, see mergeAggregations. An error response takes precedence
+// over the responses merged into it. The returned flags tell which responses
+// had metrics that couldn't be combined.
+func (rp *responseParser) mergeResponses() ([]*es.SearchResponse, []*Query, []bool) {
+	responses := make([]*es.SearchResponse, 0, len(rp.Responses))
+	targets := make([]*Query, 0, len(rp.Targets))
+	unmerged := make([]bool, 0, len(rp.Responses))
+	indexByRefID := make(map[string]int)
+	copied := make(map[int]bool)
+
+	for i, res := range rp.Responses {
+		target := rp.Targets[i]
+		idx, exists := indexByRefID[target.RefID]
+		if !exists {
+			indexByRefID[target.RefID] = len(responses)
+			responses = append(responses, res)
+			targets = append(targets, target)
+			unmerged = append(unmerged, false)
+			continue
+		}
+
+		metrics := make(map[string]*MetricAgg, len(target.Metrics))
+		for _, metric := range target.Metrics {
+			metrics[metric.ID] = metric
+		}
+
+		if responses[idx].Error != nil {
+			continue
+		}
+
+		// copy the first response before merging so the original responses are never modified
+		if !copied[idx] {
+			merged := *responses[idx]
+			merged.Aggregations = make(map[string]interface{})
+			mergeAggregations(merged.Aggregations, responses[idx].Aggregations, metrics)
+			responses[idx] = &merged
+			copied[idx] = true
+		}
+
+		merged := responses[idx]
+		if res.Error != nil {
+			merged.Error = res.Error
+			continue
+		}
+		if !mergeAggregations(merged.Aggregations, res.Aggregations, metrics) {
+			unmerged[idx] = true
+		}
+	}
+
+	return responses, targets, unmerged
+}
+
+// mergeAggregations merges the aggregations of src into dst. Doc counts are
+// summed, buckets are merged and values of the given metrics are combined
+// where possible, see mergeMetric. Metrics that can't be combined, such as
+// averages or percentiles, are left empty and false is returned. Other values
+// already in dst are kept.
+func mergeAggregations(dst, src map[string]interface{}, metrics map[string]*MetricAgg) bool {
+	merged := true
+	for key, srcValue := range src {
+		dstValue, exists := dst[key]
+		if !exists {
+			dst[key] = copyJSONValue(srcValue)
+			continue
+		}
+
+		if key == "doc_count" {
+			dst[key] = castToNullFloat(simplejson.NewFromAny(dstValue)).Float64 + castToNullFloat(simplejson.NewFromAny(srcValue)).Float64
+			continue
+		}
+
+		dstAgg, dstOk := dstValue.(map[string]interface{})
+		srcAgg, srcOk := srcValue.(map[string]interface{})
+		if !dstOk || !srcOk {
+			continue
+		}
+
+		if metric, ok := metrics[key]; ok {
+			if !mergeMetric(metric, dstAgg, srcAgg) {
+				// keep an empty metric so values of later responses aren't copied in as is
+				dst[key] = map[string]interface{}{}
+				merged = false
+			}
+			continue
+		}
+
+		if _, hasBuckets := srcAgg["buckets"]; hasBuckets {
+			buckets, ok := mergeBuckets(dstAgg["buckets"], srcAgg["buckets"], metrics)
+			dstAgg["buckets"] = buckets
+			merged = merged && ok
+			continue
+		}
+
+		if !mergeAggregations(dstAgg, srcAgg, metrics) {
+			merged = false
+		}
+	}
+	return merged
+}
+
+// mergeMetric combines the value of a metric in src into dst. Sums and value
+// counts are added up and the lowest or highest of min and max values is
+// kept. Returns false for metrics that can't be combined from their values.
+func mergeMetric(metric *MetricAgg, dst, src map[string]interface{}) bool {
+	switch metric.Type {
+	case sumType, valueCountType, minType, maxType:
+	default:
+		return false
+	}
+
+	dstValue := castToNullFloat(simplejson.NewFromAny(dst["value"]))
+	srcValue := castToNullFloat(simplejson.NewFromAny(src["value"]))
+
+	if !srcValue.Valid {
+		return true
+	}
+	if !dstValue.Valid {
+		dst["value"] = srcValue.Float64
+		return true
+	}
+
+	switch metric.Type {
+	case minType:
+		dst["value"] = math.Min(dstValue.Float64, srcValue.Float64)
+	case maxType:
+		dst["value"] = math.Max(dstValue.Float64, srcValue.Float64)
+	default:
+		dst["value"] = dstValue.Float64 + srcValue.Float64
+	}
+	return true
+}
+
+// mergeBuckets merges keyed or unkeyed buckets, combining buckets with the
+// same key. Returns false if metrics of the buckets couldn't be combined.
+func mergeBuckets(dst, src interface{}, metrics map[string]*MetricAgg) (interface{}, bool) {
+	if srcBuckets, ok := src.(map[string]interface{}); ok {
+		dstBuckets, ok := dst.(map[string]interface{})
+		if !ok {
+			return dst, true
+		}
+		return dstBuckets, mergeAggregations(dstBuckets, srcBuckets, metrics)
+	}
+
+	srcBuckets, srcOk := src.([]interface{})
+	dstBuckets, dstOk := dst.([]interface{})
+	if !srcOk || !dstOk {
+		return dst, true
+	}
+
+	merged := true
+
+	indexByKey := make(map[string]int)
+	for i, b := range dstBuckets {
+		if key, ok := getBucketKeyString(simplejson.NewFromAny(b)); ok {
+			indexByKey[key] = i
+		}
+	}
+
+	for _, b := range srcBuckets {
+		srcBucket, ok := b.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		key, hasKey := getBucketKeyString(simplejson.NewFromAny(srcBucket))
+		if i, exists := indexByKey[key]; hasKey && exists {
+			if !mergeAggregations(dstBuckets[i].(map[string]interface{}), srcBucket, metrics) {
+				merged = false
+			}
+			continue
+		}
+		if hasKey {
+			indexByKey[key] = len(dstBuckets)
+		}
+		dstBuckets = append(dstBuckets, copyJSONValue(srcBucket))
+	}
+
+	return dstBuckets, merged
+}
+
+// copyJSONValue returns a deep copy of a decoded JSON value so merging never
+// modifies the original responses.
+func copyJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = copyJSONValue(item)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, item := range v {
+			a[i] = copyJSONValue(item)
+		}
+		return a
+	default:
+		return v
+	}
+}
+
+// processBuckets walks the bucket aggregations of a response. props holds the
+// string form of the parent bucket keys, used for series tags and aliases,
+// while propValues keeps their original type for table columns.
+func (rp *responseParser) processBuckets(aggs map[string]interface{}, target *Query, queryRes *tsdb.QueryResult, table *tsdb.Table, props map[string]string, propValues map[string]interface{}, depth int) error {
 	var err error
 	maxDepth := len(target.BucketAggs) - 1
 
+	if depth >= rp.MaxDepth {
+		return &structuralError{fmt.Sprintf("bucket aggregations are nested deeper than the maximum depth of %d", rp.MaxDepth)}
+	}
+
 	aggIDs := make([]string, 0)
 	for k := range aggs {
 		aggIDs = append(aggIDs, k)
@@ -102,71 +468,275 @@ func (rp *responseParser) processBuckets(aggs map[string]interface{}, target *Qu
 			continue
 		}
 
+		if err := checkBuckets(esAgg, aggDef, target, queryRes); err != nil {
+			return err
+		}
+
+		if aggMeta, ok := esAgg.CheckGet("meta"); ok {
+			meta := getQueryResultMeta(queryRes)
+			// nested aggregations return the same meta in every parent bucket
+			if _, exists := meta.Get("aggregationMeta").CheckGet(aggDef.ID); !exists {
+				meta.SetPath([]string{"aggregationMeta", aggDef.ID}, aggMeta.Interface())
+			}
+		}
+
+		if aggDef.Type == termsType {
+			addTermsFilterMeta(queryRes, aggDef, esAgg)
+			addExecutionHintMeta(queryRes, aggDef)
+			addCollectModeMeta(queryRes, aggDef)
+
+			if target.StrictTermAccuracy {
+				docCountError := esAgg.Get("doc_count_error_upper_bound").MustInt64(0)
+				if docCountError > target.MaxDocCountError {
+					return fmt.Errorf("terms aggregation on %s has a doc count error of up to %d, above the allowed %d", aggDef.Field, docCountError, target.MaxDocCountError)
+				}
+			}
+		}
+
+		if aggDef.Type == rareTermsType {
+			// rare_terms buckets are kept in the order returned by Elasticsearch
+			maxDocCount := aggDef.Settings.Get("max_doc_count").MustInt64(1)
+			getQueryResultMeta(queryRes).SetPath([]string{"rareTermsMaxDocCount", aggDef.ID}, maxDocCount)
+		}
+
+		if isSamplerAgg(aggDef) && depth < maxDepth {
+			if aggDef.Type == diversifiedSamplerType {
+				addDiversifiedSamplerMeta(queryRes, aggDef)
+			}
+			// samplers return a single bucket holding the nested aggregations
+			err = rp.processBuckets(esAgg.MustMap(), target, queryRes, table, props, propValues, depth+1)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if target.Output == heatmapOutput && isHeatmapQuery(target) {
+			rp.processHeatmap(esAgg, target.BucketAggs[1], target, queryRes, table, getTimeColumn(target))
+			continue
+		}
+
 		if depth == maxDepth {
 			if aggDef.Type == dateHistType {
-				err = rp.processMetrics(esAgg, target, series, props)
+				// keyed date histograms return their buckets as an object
+				if buckets, _, keyed := getBuckets(esAgg); keyed {
+					array := make([]interface{}, 0, len(buckets))
+					for _, bucket := range buckets {
+						array = append(array, bucket.Interface())
+					}
+					esAgg.Set("buckets", array)
+				}
+				if target.RawBuckets {
+					meta := getQueryResultMeta(queryRes)
+					rawBuckets := meta.Get("rawBuckets").MustArray()
+					for _, b := range esAgg.Get("buckets").MustArray() {
+						rawBuckets = append(rawBuckets, getRawBucket(simplejson.NewFromAny(b)))
+					}
+					meta.Set("rawBuckets", rawBuckets)
+				}
+				produced := 0
+				for _, s := range queryRes.Series {
+					produced += len(s.Points)
+				}
+				firstNewSeries := len(queryRes.Series)
+				err = rp.processMetrics(esAgg, target, &queryRes.Series, props)
+				// the row limit applies to the points of all series of the target
+				for _, s := range queryRes.Series[firstNewSeries:] {
+					limit := getRowLimit(target, queryRes, produced, len(s.Points))
+					s.Points = s.Points[:limit]
+					produced += limit
+				}
+			} else if geoLine := findGeoLineMetric(target); geoLine != nil {
+				err = rp.processGeoLineDocs(esAgg, aggDef, geoLine, target, queryRes, table, props, propValues)
+			} else if matrix := findMatrixStatsMetric(target); matrix != nil {
+				rp.processMatrixStatsDocs(esAgg, aggDef, matrix, target, queryRes, table, props, propValues)
 			} else {
-				err = rp.processAggregationDocs(esAgg, aggDef, target, table, props)
+				err = rp.processAggregationDocs(esAgg, aggDef, target, queryRes, table, props, propValues)
 			}
 			if err != nil {
 				return err
 			}
 		} else {
-			for _, b := range esAgg.Get("buckets").MustArray() {
-				bucket := simplejson.NewFromAny(b)
+			buckets, bucketKeys, keyed := getBuckets(esAgg)
+			formattedKey := hasFormattedKeyColumn(aggDef)
+			for i, bucket := range buckets {
 				newProps := make(map[string]string)
+				newPropValues := make(map[string]interface{})
 
 				for k, v := range props {
 					newProps[k] = v
 				}
 
-				if key, err := bucket.Get("key").String(); err == nil {
-					newProps[aggDef.Field] = key
-				} else if key, err := bucket.Get("key").Int64(); err == nil {
-					newProps[aggDef.Field] = strconv.FormatInt(key, 10)
+				if keyed {
+					newProps["filter"] = bucketKeys[i]
+					if query, ok := getFilterQuery(aggDef, bucketKeys[i]); ok {
+						newProps["filterQuery"] = query
+					}
+
+					err = rp.processBuckets(bucket.MustMap(), target, queryRes, table, newProps, propValues, depth+1)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+
+				for k, v := range propValues {
+					newPropValues[k] = v
 				}
 
-				if key, err := bucket.Get("key_as_string").String(); err == nil {
+				if aggDef.Type == filtersType {
+					label, query, ok := getFilterBucketLabel(aggDef, i)
+					newProps["filter"] = label
+					if ok {
+						newProps["filterQuery"] = query
+					}
+				} else if aggDef.Type == ipRangeType {
+					newProps[aggDef.Field] = getIPRangeLabel(bucket)
+				} else if aggDef.Type == compositeType {
+					for _, source := range getCompositeSources(aggDef, bucket) {
+						newProps[source] = getCompositeValue(aggDef, bucket, source)
+						newPropValues[source] = getCompositeTypedValue(aggDef, bucket, source)
+					}
+				} else if key, ok := getHistogramIntKey(aggDef, bucket); ok {
+					newProps[aggDef.Field] = strconv.FormatInt(key, 10)
+					newPropValues[aggDef.Field] = key
+					if formattedKey {
+						newPropValues[aggDef.Field+" formatted"] = getFormattedBucketKey(bucket)
+					}
+				} else if key, ok := getBucketKeyString(bucket); ok {
 					newProps[aggDef.Field] = key
+					newPropValues[aggDef.Field] = getBucketKey(bucket)
+					if formattedKey {
+						newPropValues[aggDef.Field] = getRawBucketKey(bucket)
+						newPropValues[aggDef.Field+" formatted"] = getFormattedBucketKey(bucket)
+					}
 				}
-				err = rp.processBuckets(bucket.MustMap(), target, series, table, newProps, depth+1)
+				err = rp.processBuckets(bucket.MustMap(), target, queryRes, table, newProps, newPropValues, depth+1)
 				if err != nil {
 					return err
 				}
 			}
+		}
+
+	}
+	return nil
+
+}
+
+// estimateSeriesCount estimates the number of series a response produces for
+// a target without building them, so that responses above the MaxSeries limit
+// of the target are rejected before parsing. Terminal aggregations other than
+// date histograms are counted as one table row per bucket.
+func (rp *responseParser) estimateSeriesCount(target *Query, response *es.SearchResponse) int {
+	return rp.estimateBucketsSeriesCount(response.Aggregations, target, 0)
+}
+
+func (rp *responseParser) estimateBucketsSeriesCount(aggs map[string]interface{}, target *Query, depth int) int {
+	maxDepth := len(target.BucketAggs) - 1
+	if depth >= rp.MaxDepth {
+		return 0
+	}
+
+	count := 0
+	for aggID, v := range aggs {
+		aggDef, _ := findAgg(target, aggID)
+		if aggDef == nil {
+			continue
+		}
+		esAgg := simplejson.NewFromAny(v)
 
-			buckets := esAgg.Get("buckets").MustMap()
-			bucketKeys := make([]string, 0)
-			for k := range buckets {
-				bucketKeys = append(bucketKeys, k)
+		if depth == maxDepth {
+			if aggDef.Type == dateHistType {
+				count += estimateMetricsSeriesCount(esAgg, target)
+			} else {
+				buckets, _, _ := getBuckets(esAgg)
+				count += len(buckets)
 			}
-			sort.Strings(bucketKeys)
+			continue
+		}
 
-			for _, bucketKey := range bucketKeys {
-				bucket := simplejson.NewFromAny(buckets[bucketKey])
-				newProps := make(map[string]string)
+		if isSamplerAgg(aggDef) {
+			count += rp.estimateBucketsSeriesCount(esAgg.MustMap(), target, depth+1)
+			continue
+		}
 
-				for k, v := range props {
-					newProps[k] = v
-				}
+		buckets, _, _ := getBuckets(esAgg)
+		for _, bucket := range buckets {
+			count += rp.estimateBucketsSeriesCount(bucket.MustMap(), target, depth+1)
+		}
+	}
 
-				newProps["filter"] = bucketKey
+	return count
+}
 
-				err = rp.processBuckets(bucket.MustMap(), target, series, table, newProps, depth+1)
-				if err != nil {
-					return err
+// estimateMetricsSeriesCount returns the number of series processMetrics
+// builds from the buckets of a date histogram, which may be keyed.
+func estimateMetricsSeriesCount(esAgg *simplejson.Json, target *Query) int {
+	jsonBuckets, _, _ := getBuckets(esAgg)
+	buckets := make([]interface{}, 0, len(jsonBuckets))
+	for _, bucket := range jsonBuckets {
+		buckets = append(buckets, bucket.Interface())
+	}
+
+	count := 0
+	for _, metric := range getDateHistogramMetrics(target) {
+		if metric.Hide || metric.Type == bucketSelectorType {
+			continue
+		}
+
+		switch metric.Type {
+		case percentilesType, boxplotType:
+			if len(buckets) == 0 {
+				continue
+			}
+			if metric.Type == percentilesType {
+				count += len(getBucketsPercentileKeys(buckets, metric))
+			} else {
+				count += len(getBoxplotStats(simplejson.NewFromAny(buckets[0]).Get(metric.ID)))
+			}
+		case statsType:
+			count += len(getStatsKeys(metric))
+		case matrixStatsType:
+			if len(buckets) == 0 {
+				continue
+			}
+			firstBucket := simplejson.NewFromAny(buckets[0])
+			count += len(getMatrixStatsFields(metric, firstBucket.Get(metric.ID))) * len(matrixStatsSeries)
+		case extendedStatsType:
+			for _, v := range metric.Meta.MustMap() {
+				if enabled, ok := v.(bool); ok && enabled {
+					count++
 				}
 			}
+		default:
+			count++
 		}
-
 	}
-	return nil
 
+	return count
 }
 
+// getDateHistogramMetrics returns the metrics of the target to build time
+// series for. Targets without metrics, whether the metrics are missing or an
+// empty list, get a count of the documents in each bucket.
+func getDateHistogramMetrics(target *Query) []*MetricAgg {
+	if len(target.Metrics) > 0 {
+		return target.Metrics
+	}
+	return []*MetricAgg{{Type: countType, Settings: simplejson.New(), Meta: simplejson.New()}}
+}
+
+// processMetrics builds time series from the buckets of a date histogram. The
+// numeric bucket key is always used as timestamp and never key_as_string:
+// Elasticsearch already shifts the epoch keys by any configured offset,
+// including negative offsets or offsets larger than the interval, so the
+// offset setting is not read here, while key_as_string depends on the
+// requested format.
 func (rp *responseParser) processMetrics(esAgg *simplejson.Json, target *Query, series *tsdb.TimeSeriesSlice, props map[string]string) error {
-	for _, metric := range target.Metrics {
-		if metric.Hide {
+	firstNewSeries := len(*series)
+
+	for _, metric := range getDateHistogramMetrics(target) {
+		if metric.Hide || metric.Type == bucketSelectorType {
 			continue
 		}
 
@@ -187,6 +757,7 @@ func (rp *responseParser) processMetrics(esAgg *simplejson.Json, target *Query,
 				newSeries.Tags[k] = v
 			}
 			newSeries.Tags["metric"] = countType
+			newSeries.Tags["metricId"] = metric.ID
 			*series = append(*series, &newSeries)
 
 		case percentilesType:
@@ -195,23 +766,18 @@ func (rp *responseParser) processMetrics(esAgg *simplejson.Json, target *Query,
 				break
 			}
 
-			firstBucket := simplejson.NewFromAny(buckets[0])
-			percentiles := firstBucket.GetPath(metric.ID, "values").MustMap()
-
-			percentileKeys := make([]string, 0)
-			for k := range percentiles {
-				percentileKeys = append(percentileKeys, k)
-			}
-			sort.Strings(percentileKeys)
-			for _, percentileName := range percentileKeys {
+			for _, percentileName := range getBucketsPercentileKeys(buckets, metric) {
+				// every percentile gets its own points so series never share
+				// backing arrays
 				newSeries := tsdb.TimeSeries{
-					Tags: make(map[string]string),
+					Tags:   make(map[string]string),
+					Points: make(tsdb.TimeSeriesPoints, 0, len(buckets)),
 				}
 				for k, v := range props {
 					newSeries.Tags[k] = v
 				}
 				newSeries.Tags["metric"] = "p" + percentileName
-				newSeries.Tags["field"] = metric.Field
+				newSeries.Tags["field"] = getMetricFieldName(metric)
 				for _, v := range buckets {
 					bucket := simplejson.NewFromAny(v)
 					value := castToNullFloat(bucket.GetPath(metric.ID, "values", percentileName))
@@ -242,7 +808,7 @@ func (rp *responseParser) processMetrics(esAgg *simplejson.Json, target *Query,
 					newSeries.Tags[k] = v
 				}
 				newSeries.Tags["metric"] = statName
-				newSeries.Tags["field"] = metric.Field
+				newSeries.Tags["field"] = getMetricFieldName(metric)
 
 				for _, v := range buckets {
 					bucket := simplejson.NewFromAny(v)
@@ -259,53 +825,193 @@ func (rp *responseParser) processMetrics(esAgg *simplejson.Json, target *Query,
 				}
 				*series = append(*series, &newSeries)
 			}
-		default:
-			newSeries := tsdb.TimeSeries{
-				Tags: make(map[string]string),
-			}
-			for k, v := range props {
-				newSeries.Tags[k] = v
-			}
+		case statsType:
+			buckets := esAgg.Get("buckets").MustArray()
 
-			newSeries.Tags["metric"] = metric.Type
-			newSeries.Tags["field"] = metric.Field
-			newSeries.Tags["metricId"] = metric.ID
-			for _, v := range esAgg.Get("buckets").MustArray() {
-				bucket := simplejson.NewFromAny(v)
-				key := castToNullFloat(bucket.Get("key"))
-				valueObj, err := bucket.Get(metric.ID).Map()
-				if err != nil {
-					continue
+			for _, statName := range getStatsKeys(metric) {
+				newSeries := tsdb.TimeSeries{
+					Tags: make(map[string]string),
 				}
-				var value null.Float
-				if _, ok := valueObj["normalized_value"]; ok {
-					value = castToNullFloat(bucket.GetPath(metric.ID, "normalized_value"))
-				} else {
-					value = castToNullFloat(bucket.GetPath(metric.ID, "value"))
+				for k, v := range props {
+					newSeries.Tags[k] = v
 				}
-				newSeries.Points = append(newSeries.Points, tsdb.TimePoint{value, key})
+				newSeries.Tags["metric"] = statName
+				newSeries.Tags["field"] = getMetricFieldName(metric)
+
+				for _, v := range buckets {
+					bucket := simplejson.NewFromAny(v)
+					value := castToNullFloat(bucket.GetPath(metric.ID, statName))
+					key := castToNullFloat(bucket.Get("key"))
+					newSeries.Points = append(newSeries.Points, tsdb.TimePoint{value, key})
+				}
+				*series = append(*series, &newSeries)
+			}
+		case matrixStatsType:
+			buckets := esAgg.Get("buckets").MustArray()
+			if len(buckets) == 0 {
+				break
 			}
-			*series = append(*series, &newSeries)
-		}
-	}
-	return nil
-}
 
-func (rp *responseParser) processAggregationDocs(esAgg *simplejson.Json, aggDef *BucketAgg, target *Query, table *tsdb.Table, props map[string]string) error {
-	propKeys := make([]string, 0)
-	for k := range props {
-		propKeys = append(propKeys, k)
+			firstBucket := simplejson.NewFromAny(buckets[0])
+			for _, field := range getMatrixStatsFields(metric, firstBucket.Get(metric.ID)) {
+				for _, statName := range matrixStatsSeries {
+					newSeries := tsdb.TimeSeries{
+						Tags: make(map[string]string),
+					}
+					for k, v := range props {
+						newSeries.Tags[k] = v
+					}
+					newSeries.Tags["metric"] = matrixStatsType + "_" + statName
+					newSeries.Tags["field"] = field
+
+					for _, v := range buckets {
+						bucket := simplejson.NewFromAny(v)
+						value := castToNullFloat(getMatrixStatsField(bucket.Get(metric.ID), field).Get(statName))
+						key := castToNullFloat(bucket.Get("key"))
+						newSeries.Points = append(newSeries.Points, tsdb.TimePoint{value, key})
+					}
+					*series = append(*series, &newSeries)
+				}
+			}
+		case boxplotType:
+			buckets := esAgg.Get("buckets").MustArray()
+			if len(buckets) == 0 {
+				break
+			}
+
+			firstBucket := simplejson.NewFromAny(buckets[0])
+			for _, statName := range getBoxplotStats(firstBucket.Get(metric.ID)) {
+				newSeries := tsdb.TimeSeries{
+					Tags: make(map[string]string),
+				}
+				for k, v := range props {
+					newSeries.Tags[k] = v
+				}
+				newSeries.Tags["metric"] = boxplotType + "_" + statName
+				newSeries.Tags["field"] = getMetricFieldName(metric)
+
+				for _, v := range buckets {
+					bucket := simplejson.NewFromAny(v)
+					value := castToNullFloat(bucket.GetPath(metric.ID, statName))
+					key := castToNullFloat(bucket.Get("key"))
+					newSeries.Points = append(newSeries.Points, tsdb.TimePoint{value, key})
+				}
+				*series = append(*series, &newSeries)
+			}
+		default:
+			newSeries := tsdb.TimeSeries{
+				Tags: make(map[string]string),
+			}
+			for k, v := range props {
+				newSeries.Tags[k] = v
+			}
+
+			newSeries.Tags["metric"] = metric.Type
+			newSeries.Tags["field"] = getMetricFieldName(metric)
+			newSeries.Tags["metricId"] = metric.ID
+			for _, v := range esAgg.Get("buckets").MustArray() {
+				bucket := simplejson.NewFromAny(v)
+				key := castToNullFloat(bucket.Get("key"))
+				valueObj, err := bucket.Get(metric.ID).Map()
+				if err != nil {
+					continue
+				}
+				var value null.Float
+				if _, ok := valueObj["normalized_value"]; ok {
+					value = castToNullFloat(bucket.GetPath(metric.ID, "normalized_value"))
+				} else {
+					value = castToNullFloat(bucket.GetPath(metric.ID, "value"))
+				}
+				newSeries.Points = append(newSeries.Points, tsdb.TimePoint{value, key})
+			}
+			*series = append(*series, &newSeries)
+		}
 	}
-	sort.Strings(propKeys)
 
-	if len(table.Columns) == 0 {
+	sumDuplicates := false
+	timeZone := ""
+	for _, bucketAgg := range target.BucketAggs {
+		if bucketAgg.Type == dateHistType {
+			sumDuplicates = bucketAgg.Settings.Get("duplicateTimestamps").MustString() == "sum"
+			timeZone = bucketAgg.Settings.Get("time_zone").MustString()
+			break
+		}
+	}
+	for _, s := range (*series)[firstNewSeries:] {
+		s.Points = sortPointsByTime(s.Points, sumDuplicates)
+	}
+
+	if target.AlignInterval != "" {
+		align, err := getAlignFunc(target.AlignInterval)
+		if err != nil {
+			return err
+		}
+		loc, err := getTimeZoneLocation(timeZone)
+		if err != nil {
+			return err
+		}
+		for _, s := range (*series)[firstNewSeries:] {
+			alignPoints(s.Points, align, loc)
+		}
+	}
+
+	if target.SignificantDigits > 0 {
+		for _, s := range (*series)[firstNewSeries:] {
+			for i, point := range s.Points {
+				if point[0].Valid {
+					s.Points[i][0] = null.FloatFrom(roundToSignificantDigits(point[0].Float64, target.SignificantDigits))
+				}
+			}
+		}
+	}
+
+	if target.DropAllNullSeries {
+		kept := (*series)[:firstNewSeries]
+		for _, s := range (*series)[firstNewSeries:] {
+			if !isAllNull(s) {
+				kept = append(kept, s)
+			}
+		}
+		*series = kept
+	}
+
+	return nil
+}
+
+func (rp *responseParser) processAggregationDocs(esAgg *simplejson.Json, aggDef *BucketAgg, target *Query, queryRes *tsdb.QueryResult, table *tsdb.Table, props map[string]string, propValues map[string]interface{}) error {
+	propKeys := getTablePropKeys(props, propValues)
+
+	buckets, bucketKeys, keyed := getBuckets(esAgg)
+	buckets = buckets[:getRowLimit(target, queryRes, len(table.Rows), len(buckets))]
+
+	var sources []string
+	if aggDef.Type == compositeType && len(buckets) > 0 {
+		sources = getCompositeSources(aggDef, buckets[0])
+	}
+	formattedKey := hasFormattedKeyColumn(aggDef)
+
+	if len(table.Columns) == 0 && len(buckets) > 0 {
 		for _, propKey := range propKeys {
 			table.Columns = append(table.Columns, tsdb.TableColumn{Text: propKey})
 		}
-		table.Columns = append(table.Columns, tsdb.TableColumn{Text: aggDef.Field})
+		if aggDef.Type == compositeType {
+			for _, source := range sources {
+				table.Columns = append(table.Columns, tsdb.TableColumn{Text: source})
+			}
+		} else {
+			table.Columns = append(table.Columns, tsdb.TableColumn{Text: aggDef.Field})
+		}
+		if formattedKey {
+			table.Columns = append(table.Columns, tsdb.TableColumn{Text: aggDef.Field + " formatted"})
+		}
+		if aggDef.Type == geotileGridType {
+			for _, column := range getGeotileColumns(aggDef) {
+				table.Columns = append(table.Columns, tsdb.TableColumn{Text: column})
+			}
+		}
 	}
 
-	addMetricValue := func(values *tsdb.RowValues, metricName string, value null.Float) {
+	addMetricValue := func(values *tsdb.RowValues, metricName string, value interface{}) {
 		found := false
 		for _, c := range table.Columns {
 			if c.Text == metricName {
@@ -319,24 +1025,48 @@ func (rp *responseParser) processAggregationDocs(esAgg *simplejson.Json, aggDef
 		*values = append(*values, value)
 	}
 
-	for _, v := range esAgg.Get("buckets").MustArray() {
-		bucket := simplejson.NewFromAny(v)
+	for i, bucket := range buckets {
 		values := make(tsdb.RowValues, 0)
 
 		for _, propKey := range propKeys {
-			values = append(values, props[propKey])
+			values = append(values, getPropValue(props, propValues, propKey))
 		}
 
-		if key, err := bucket.Get("key").String(); err == nil {
+		if keyed {
+			values = append(values, bucketKeys[i])
+		} else if aggDef.Type == filtersType {
+			label, _, _ := getFilterBucketLabel(aggDef, i)
+			values = append(values, label)
+		} else if aggDef.Type == compositeType {
+			for _, source := range sources {
+				values = append(values, getCompositeTypedValue(aggDef, bucket, source))
+			}
+		} else if aggDef.Type == ipRangeType {
+			values = append(values, getIPRangeLabel(bucket))
+		} else if key, ok := getHistogramIntKey(aggDef, bucket); ok {
 			values = append(values, key)
+		} else if formattedKey {
+			values = append(values, getRawBucketKey(bucket))
 		} else {
-			values = append(values, castToNullFloat(bucket.Get("key")))
+			values = append(values, getBucketKey(bucket))
+		}
+
+		if formattedKey {
+			values = append(values, getFormattedBucketKey(bucket))
+		}
+
+		if aggDef.Type == geotileGridType {
+			values = append(values, getGeotileValues(bucket.Get("key").MustString(), aggDef)...)
 		}
 
 		for _, metric := range target.Metrics {
+			if metric.Hide || metric.Type == bucketSelectorType {
+				continue
+			}
+
 			switch metric.Type {
 			case countType:
-				addMetricValue(&values, rp.getMetricName(metric.Type), castToNullFloat(bucket.Get("doc_count")))
+				addMetricValue(&values, rp.getCountName(metric, target), castToNullFloat(bucket.Get("doc_count")))
 			case extendedStatsType:
 				metaKeys := make([]string, 0)
 				meta := metric.Meta.MustMap()
@@ -362,178 +1092,707 @@ func (rp *responseParser) processAggregationDocs(esAgg *simplejson.Json, aggDef
 					addMetricValue(&values, rp.getMetricName(metric.Type), value)
 					break
 				}
+			case percentilesType:
+				valuesAsString := metric.Settings.Get("valuesAsString").MustBool(false)
+				for _, percentileName := range getPercentileKeys(bucket.GetPath(metric.ID, "values").MustMap()) {
+					metricName := "p" + percentileName
+					addMetricValue(&values, metricName, castToNullFloat(bucket.GetPath(metric.ID, "values", percentileName)))
+					if valuesAsString {
+						formatted := bucket.GetPath(metric.ID, "values", percentileName+"_as_string").MustString()
+						addMetricValue(&values, metricName+" formatted", formatted)
+					}
+				}
+			case statsType:
+				for _, statName := range getStatsKeys(metric) {
+					metricName := extendedStats[statName]
+					if field := getMetricFieldName(metric); field != "" {
+						metricName += " " + field
+					}
+					addMetricValue(&values, metricName, castToNullFloat(bucket.GetPath(metric.ID, statName)))
+				}
+			case boxplotType:
+				for _, statName := range getBoxplotStats(bucket.Get(metric.ID)) {
+					addMetricValue(&values, boxplotStats[statName], castToNullFloat(bucket.GetPath(metric.ID, statName)))
+				}
+			case topHitsType:
+				field := getTopHitsField(metric)
+				if field == "" {
+					continue
+				}
+				addMetricValue(&values, field, getTopHitsValue(bucket.Get(metric.ID), field))
 			default:
 				metricName := rp.getMetricName(metric.Type)
 				otherMetrics := make([]*MetricAgg, 0)
+				sameFieldMetrics := 0
 
 				for _, m := range target.Metrics {
 					if m.Type == metric.Type {
 						otherMetrics = append(otherMetrics, m)
+						if m.Field == metric.Field {
+							sameFieldMetrics++
+						}
 					}
 				}
 
-				if len(otherMetrics) > 1 {
-					metricName += " " + metric.Field
+				if field := getMetricFieldName(metric); len(otherMetrics) > 1 && field != "" {
+					metricName += " " + field
+				}
+
+				if sameFieldMetrics > 1 && metric.Type == cardinalityType {
+					if precision, err := metric.Settings.Get("precision_threshold").Int64(); err == nil {
+						metricName += " (precision " + strconv.FormatInt(precision, 10) + ")"
+					}
 				}
 
-				addMetricValue(&values, metricName, castToNullFloat(bucket.GetPath(metric.ID, "value")))
+				addMetricValue(&values, metricName, getMetricValue(metric, bucket.GetPath(metric.ID, "value")))
 			}
 		}
 
+		if target.RawBuckets {
+			addMetricValue(&values, "Raw", getRawBucket(bucket))
+		}
+
 		table.Rows = append(table.Rows, values)
 	}
 
 	return nil
 }
 
-func (rp *responseParser) trimDatapoints(series *tsdb.TimeSeriesSlice, target *Query) {
-	var histogram *BucketAgg
-	for _, bucketAgg := range target.BucketAggs {
-		if bucketAgg.Type == dateHistType {
-			histogram = bucketAgg
-			break
+// coalesceSeries merges series with identical tags into the first of them,
+// according to the CoalesceSeries mode of the target. Points sharing a
+// timestamp are summed in sum mode and all kept in keep mode.
+func (rp *responseParser) coalesceSeries(seriesList *tsdb.TimeSeriesSlice, target *Query) {
+	if target.CoalesceSeries != coalesceSum && target.CoalesceSeries != coalesceKeep {
+		return
+	}
+
+	coalesced := make(tsdb.TimeSeriesSlice, 0, len(*seriesList))
+	seriesByTags := make(map[string]*tsdb.TimeSeries)
+	for _, series := range *seriesList {
+		key := getTagsKey(series.Tags)
+		if existing, ok := seriesByTags[key]; ok {
+			existing.Points = append(existing.Points, series.Points...)
+			continue
 		}
+		seriesByTags[key] = series
+		coalesced = append(coalesced, series)
 	}
 
-	if histogram == nil {
+	if len(coalesced) == len(*seriesList) {
 		return
 	}
 
-	trimEdges, err := histogram.Settings.Get("trimEdges").Int()
-	if err != nil {
+	for _, series := range coalesced {
+		series.Points = sortPointsByTime(series.Points, target.CoalesceSeries == coalesceSum)
+	}
+	*seriesList = coalesced
+}
+
+// addTotalSeries appends, for every count and sum metric of a target with the
+// TotalSeries setting, a series summing the metric across all terms at each
+// timestamp. Its term tags are set to Total. Other metrics, such as averages,
+// can't be summed across terms and get no total series.
+func (rp *responseParser) addTotalSeries(seriesList *tsdb.TimeSeriesSlice, target *Query) {
+	if !target.TotalSeries || !hasTermsAgg(target) {
 		return
 	}
 
-	for _, s := range *series {
-		if len(s.Points) > trimEdges*2 {
-			s.Points = s.Points[trimEdges : len(s.Points)-trimEdges]
+	totals := make(tsdb.TimeSeriesSlice, 0)
+	totalsByMetric := make(map[string]*tsdb.TimeSeries)
+	for _, series := range *seriesList {
+		metricType := series.Tags["metric"]
+		if metricType != countType && metricType != sumType {
+			continue
 		}
-	}
-}
 
-func (rp *responseParser) nameSeries(seriesList *tsdb.TimeSeriesSlice, target *Query) {
-	set := make(map[string]string)
-	for _, v := range *seriesList {
-		if metricType, exists := v.Tags["metric"]; exists {
-			if _, ok := set[metricType]; !ok {
-				set[metricType] = ""
+		key := metricType + "\x00" + series.Tags["metricId"] + "\x00" + series.Tags["field"]
+		total, ok := totalsByMetric[key]
+		if !ok {
+			total = &tsdb.TimeSeries{Tags: make(map[string]string), Points: make(tsdb.TimeSeriesPoints, 0)}
+			for k, v := range series.Tags {
+				switch k {
+				case "metric", "metricId", "field":
+					total.Tags[k] = v
+				default:
+					total.Tags[k] = totalTerm
+				}
 			}
+			totalsByMetric[key] = total
+			totals = append(totals, total)
 		}
+		total.Points = append(total.Points, series.Points...)
 	}
-	metricTypeCount := len(set)
-	for _, series := range *seriesList {
-		series.Name = rp.getSeriesName(series, target, metricTypeCount)
+
+	for _, total := range totals {
+		total.Points = sortPointsByTime(total.Points, true)
 	}
+	*seriesList = append(*seriesList, totals...)
+}
 
+// hasTermsAgg returns true if the target has a terms bucket aggregation.
+func hasTermsAgg(target *Query) bool {
+	for _, aggDef := range target.BucketAggs {
+		if aggDef.Type == termsType {
+			return true
+		}
+	}
+	return false
 }
 
-var aliasPatternRegex = regexp.MustCompile(`\{\{([\s\S]+?)\}\}`)
+// getTagsKey returns a string identifying a set of series tags.
+func getTagsKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(tags[k])
+		buf.WriteByte(0)
+	}
+	return buf.String()
+}
 
-func (rp *responseParser) getSeriesName(series *tsdb.TimeSeries, target *Query, metricTypeCount int) string {
-	metricType := series.Tags["metric"]
-	metricName := rp.getMetricName(metricType)
-	delete(series.Tags, "metric")
+// fillMissingCounts aligns the count series of a query on time. Timestamps
+// present in another count series but missing from a series are inserted as
+// null or zero depending on the MissingCountAs setting of the target. Buckets
+// returned with a zero doc count are kept as is.
+func (rp *responseParser) fillMissingCounts(seriesList *tsdb.TimeSeriesSlice, target *Query) {
+	var fill null.Float
+	switch target.MissingCountAs {
+	case missingCountNull:
+		fill = null.NewFloat(0, false)
+	case missingCountZero:
+		fill = null.FloatFrom(0)
+	default:
+		return
+	}
 
-	field := ""
-	if v, ok := series.Tags["field"]; ok {
-		field = v
-		delete(series.Tags, "field")
+	// buckets dropped by a bucket_selector must not be filled back in
+	if hasBucketSelector(target) {
+		return
 	}
 
-	if target.Alias != "" {
-		seriesName := target.Alias
+	countSeries := make(tsdb.TimeSeriesSlice, 0)
+	timeSet := make(map[float64]bool)
+	for _, series := range *seriesList {
+		if series.Tags["metric"] != countType {
+			continue
+		}
+		countSeries = append(countSeries, series)
+		for _, point := range series.Points {
+			timeSet[point[1].Float64] = true
+		}
+	}
 
-		subMatches := aliasPatternRegex.FindAllStringSubmatch(target.Alias, -1)
-		for _, subMatch := range subMatches {
-			group := subMatch[0]
+	times := make([]float64, 0, len(timeSet))
+	for ts := range timeSet {
+		times = append(times, ts)
+	}
+	sort.Float64s(times)
 
-			if len(subMatch) > 1 {
-				group = subMatch[1]
-			}
+	for _, series := range countSeries {
+		existing := make(map[float64]null.Float, len(series.Points))
+		for _, point := range series.Points {
+			existing[point[1].Float64] = point[0]
+		}
 
-			if strings.Index(group, "term ") == 0 {
-				seriesName = strings.Replace(seriesName, subMatch[0], series.Tags[group[5:]], 1)
-			}
-			if v, ok := series.Tags[group]; ok {
-				seriesName = strings.Replace(seriesName, subMatch[0], v, 1)
-			}
-			if group == "metric" {
-				seriesName = strings.Replace(seriesName, subMatch[0], metricName, 1)
-			}
-			if group == "field" {
-				seriesName = strings.Replace(seriesName, subMatch[0], field, 1)
+		points := make(tsdb.TimeSeriesPoints, 0, len(times))
+		for _, ts := range times {
+			value, ok := existing[ts]
+			if !ok {
+				value = fill
 			}
+			points = append(points, tsdb.TimePoint{value, null.FloatFrom(ts)})
 		}
+		series.Points = points
+	}
+}
 
-		return seriesName
+// processGeoLineDocs adds one table row per point of the geo_line metric of
+// each bucket, keeping the point order of the line. A meta flag is set when
+// Elasticsearch truncated any of the lines because of its point limit.
+func (rp *responseParser) processGeoLineDocs(esAgg *simplejson.Json, aggDef *BucketAgg, metric *MetricAgg, target *Query, queryRes *tsdb.QueryResult, table *tsdb.Table, props map[string]string, propValues map[string]interface{}) error {
+	propKeys := getTablePropKeys(props, propValues)
+
+	if len(table.Columns) == 0 {
+		for _, propKey := range propKeys {
+			table.Columns = append(table.Columns, tsdb.TableColumn{Text: propKey})
+		}
+		table.Columns = append(table.Columns, tsdb.TableColumn{Text: aggDef.Field})
+		table.Columns = append(table.Columns, tsdb.TableColumn{Text: "lat"}, tsdb.TableColumn{Text: "lon"})
 	}
-	// todo, if field and pipelineAgg
-	if field != "" && isPipelineAgg(metricType) {
-		if isPipelineAggWithMultipleBucketPaths(metricType) {
-			metricID := ""
-			if v, ok := series.Tags["metricId"]; ok {
-				metricID = v
-			}
 
-			for _, metric := range target.Metrics {
-				if metric.ID == metricID {
-					metricName = metric.Settings.Get("script").MustString()
-					for name, pipelineAgg := range metric.PipelineVariables {
-						for _, m := range target.Metrics {
-							if m.ID == pipelineAgg {
-								metricName = strings.Replace(metricName, "params."+name, describeMetric(m.Type, m.Field), -1)
-							}
-						}
-					}
-				}
-			}
-		} else {
-			found := false
-			for _, metric := range target.Metrics {
-				if metric.ID == field {
-					metricName += " " + describeMetric(metric.Type, field)
-					found = true
-				}
+	for _, v := range esAgg.Get("buckets").MustArray() {
+		bucket := simplejson.NewFromAny(v)
+		line := bucket.Get(metric.ID)
+
+		key := getBucketKey(bucket)
+
+		if complete, err := line.GetPath("properties", "complete").Bool(); err == nil && !complete {
+			getQueryResultMeta(queryRes).Set("geoLineTruncated", true)
+		}
+
+		for _, c := range line.GetPath("geometry", "coordinates").MustArray() {
+			if getRowLimit(target, queryRes, len(table.Rows), 1) == 0 {
+				return nil
 			}
-			if !found {
-				metricName = "Unset"
+			coordinate := simplejson.NewFromAny(c)
+			values := make(tsdb.RowValues, 0)
+			for _, propKey := range propKeys {
+				values = append(values, getPropValue(props, propValues, propKey))
 			}
+			values = append(values, key)
+			values = append(values, castToNullFloat(coordinate.GetIndex(1)), castToNullFloat(coordinate.GetIndex(0)))
+			table.Rows = append(table.Rows, values)
 		}
-	} else if field != "" {
-		metricName += " " + field
 	}
 
-	delete(series.Tags, "metricId")
+	return nil
+}
 
-	if len(series.Tags) == 0 {
-		return metricName
-	}
+// processMatrixStatsDocs builds a table from a matrix_stats metric with one row
+// per bucket and field, holding the stats of the field followed by its
+// correlation with every field, so each bucket yields a correlation matrix.
+func (rp *responseParser) processMatrixStatsDocs(esAgg *simplejson.Json, aggDef *BucketAgg, metric *MetricAgg, target *Query, queryRes *tsdb.QueryResult, table *tsdb.Table, props map[string]string, propValues map[string]interface{}) {
+	propKeys := getTablePropKeys(props, propValues)
 
-	name := ""
-	for _, v := range series.Tags {
-		name += v + " "
+	buckets := esAgg.Get("buckets").MustArray()
+	if len(buckets) == 0 {
+		return
 	}
 
-	if metricTypeCount == 1 {
-		return strings.TrimSpace(name)
+	fields := getMatrixStatsFields(metric, simplejson.NewFromAny(buckets[0]).Get(metric.ID))
+	if len(table.Columns) == 0 {
+		for _, propKey := range propKeys {
+			table.Columns = append(table.Columns, tsdb.TableColumn{Text: propKey})
+		}
+		table.Columns = append(table.Columns, tsdb.TableColumn{Text: aggDef.Field}, tsdb.TableColumn{Text: "field"})
+		for _, statName := range []string{"count", "mean", "variance"} {
+			table.Columns = append(table.Columns, tsdb.TableColumn{Text: matrixStats[statName]})
+		}
+		for _, field := range fields {
+			table.Columns = append(table.Columns, tsdb.TableColumn{Text: field})
+		}
 	}
 
-	return strings.TrimSpace(name) + " " + metricName
+	for _, v := range buckets {
+		bucket := simplejson.NewFromAny(v)
+		key := getBucketKey(bucket)
+
+		for _, field := range fields {
+			if getRowLimit(target, queryRes, len(table.Rows), 1) == 0 {
+				return
+			}
+			stats := getMatrixStatsField(bucket.Get(metric.ID), field)
 
+			values := make(tsdb.RowValues, 0)
+			for _, propKey := range propKeys {
+				values = append(values, getPropValue(props, propValues, propKey))
+			}
+			values = append(values, key, field)
+			for _, statName := range []string{"count", "mean", "variance"} {
+				values = append(values, castToNullFloat(stats.Get(statName)))
+			}
+			for _, other := range fields {
+				values = append(values, castToNullFloat(stats.GetPath("correlation", other)))
+			}
+			table.Rows = append(table.Rows, values)
+		}
+	}
 }
 
-func (rp *responseParser) getMetricName(metric string) string {
-	if text, ok := metricAggType[metric]; ok {
-		return text
+// processHeatmap builds a heatmap table from a date histogram with a nested
+// histogram: one row per time bucket and one count column per histogram bin.
+// Bins are unioned across time buckets and missing bins are counted as zero.
+func (rp *responseParser) processHeatmap(esAgg *simplejson.Json, histogram *BucketAgg, target *Query, queryRes *tsdb.QueryResult, table *tsdb.Table, timeColumn string) {
+	timeBuckets := esAgg.Get("buckets").MustArray()
+	counts := make([]map[float64]null.Float, 0, len(timeBuckets))
+	times := make([]null.Float, 0, len(timeBuckets))
+	binSet := make(map[float64]bool)
+
+	for _, v := range timeBuckets {
+		timeBucket := simplejson.NewFromAny(v)
+		binCounts := make(map[float64]null.Float)
+		for _, b := range timeBucket.GetPath(histogram.ID, "buckets").MustArray() {
+			bin := simplejson.NewFromAny(b)
+			key := castToNullFloat(bin.Get("key"))
+			if !key.Valid {
+				continue
+			}
+			binSet[key.Float64] = true
+			binCounts[key.Float64] = castToNullFloat(bin.Get("doc_count"))
+		}
+		times = append(times, castToNullFloat(timeBucket.Get("key")))
+		counts = append(counts, binCounts)
 	}
 
-	if text, ok := extendedStats[metric]; ok {
+	bins := make([]float64, 0, len(binSet))
+	for bin := range binSet {
+		bins = append(bins, bin)
+	}
+	sort.Float64s(bins)
+
+	table.Columns = []tsdb.TableColumn{{Text: timeColumn}}
+	for _, bin := range bins {
+		table.Columns = append(table.Columns, tsdb.TableColumn{Text: strconv.FormatFloat(bin, 'f', -1, 64)})
+	}
+
+	times = times[:getRowLimit(target, queryRes, len(table.Rows), len(times))]
+	for i, ts := range times {
+		values := tsdb.RowValues{ts}
+		for _, bin := range bins {
+			if count, ok := counts[i][bin]; ok {
+				values = append(values, count)
+			} else {
+				values = append(values, null.FloatFrom(0))
+			}
+		}
+		table.Rows = append(table.Rows, values)
+	}
+}
+
+// trimZeroCounts drops the leading and trailing zero count datapoints of count
+// series when the date histogram has trimLeadingTrailingZeros set. Series with
+// only zero counts become empty, or keep their first datapoint when
+// trimZerosKeepOne is set.
+func (rp *responseParser) trimZeroCounts(series *tsdb.TimeSeriesSlice, target *Query) {
+	var histogram *BucketAgg
+	for _, bucketAgg := range target.BucketAggs {
+		if bucketAgg.Type == dateHistType {
+			histogram = bucketAgg
+			break
+		}
+	}
+
+	if histogram == nil || !histogram.Settings.Get("trimLeadingTrailingZeros").MustBool(false) {
+		return
+	}
+	keepOne := histogram.Settings.Get("trimZerosKeepOne").MustBool(false)
+
+	isZero := func(point tsdb.TimePoint) bool {
+		return point[0].Valid && point[0].Float64 == 0
+	}
+
+	for _, s := range *series {
+		if s.Tags["metric"] != countType {
+			continue
+		}
+
+		start, end := 0, len(s.Points)
+		for start < end && isZero(s.Points[start]) {
+			start++
+		}
+		for end > start && isZero(s.Points[end-1]) {
+			end--
+		}
+
+		if start == end && keepOne && len(s.Points) > 0 {
+			start, end = 0, 1
+		}
+		s.Points = s.Points[start:end]
+	}
+}
+
+// trimDatapoints drops trimEdges datapoints from both edges of every series. It
+// returns false if any series had too few datapoints (trimEdges*2 or fewer) to
+// be trimmed and was left untouched.
+func (rp *responseParser) trimDatapoints(series *tsdb.TimeSeriesSlice, target *Query) bool {
+	var histogram *BucketAgg
+	for _, bucketAgg := range target.BucketAggs {
+		if bucketAgg.Type == dateHistType {
+			histogram = bucketAgg
+			break
+		}
+	}
+
+	if histogram == nil {
+		return true
+	}
+
+	trimEdges, err := histogram.Settings.Get("trimEdges").Int()
+	if err != nil || trimEdges <= 0 {
+		return true
+	}
+
+	trimmed := true
+	for _, s := range *series {
+		if len(s.Points) > trimEdges*2 {
+			s.Points = s.Points[trimEdges : len(s.Points)-trimEdges]
+		} else {
+			trimmed = false
+		}
+	}
+
+	return trimmed
+}
+
+// toWideTable merges the series into a single table with one shared time column
+// and one value column per series. Series with differing buckets are aligned on
+// time and missing values are left null.
+func (rp *responseParser) toWideTable(seriesList tsdb.TimeSeriesSlice, timeColumn string) *tsdb.Table {
+	table := &tsdb.Table{
+		Columns: []tsdb.TableColumn{{Text: timeColumn}},
+		Rows:    make([]tsdb.RowValues, 0),
+	}
+
+	rowsByTime := make(map[float64]tsdb.RowValues)
+	times := make([]float64, 0)
+	for i, series := range seriesList {
+		table.Columns = append(table.Columns, tsdb.TableColumn{Text: series.Name})
+		for _, point := range series.Points {
+			if !point[1].Valid {
+				continue
+			}
+			ts := point[1].Float64
+			row, ok := rowsByTime[ts]
+			if !ok {
+				row = make(tsdb.RowValues, len(seriesList)+1)
+				row[0] = point[1]
+				for j := 1; j < len(row); j++ {
+					row[j] = null.NewFloat(0, false)
+				}
+				rowsByTime[ts] = row
+				times = append(times, ts)
+			}
+			row[i+1] = point[0]
+		}
+	}
+
+	sort.Float64s(times)
+	for _, ts := range times {
+		table.Rows = append(table.Rows, rowsByTime[ts])
+	}
+
+	return table
+}
+
+// wideTableToTimeSeries converts a table with a leading time column, as built
+// by toWideTable, back to time series with one series per value column. Null
+// cells are kept as null points.
+func (rp *responseParser) wideTableToTimeSeries(table *tsdb.Table) (tsdb.TimeSeriesSlice, error) {
+	seriesList := make(tsdb.TimeSeriesSlice, 0)
+	if len(table.Columns) < 2 {
+		return seriesList, nil
+	}
+
+	for _, column := range table.Columns[1:] {
+		seriesList = append(seriesList, &tsdb.TimeSeries{
+			Name:   column.Text,
+			Points: make(tsdb.TimeSeriesPoints, 0),
+		})
+	}
+
+	for _, row := range table.Rows {
+		if len(row) != len(table.Columns) {
+			return nil, errors.New("table row does not match the number of columns")
+		}
+		ts, ok := row[0].(null.Float)
+		if !ok {
+			return nil, errors.New("first table column is not a time column")
+		}
+		for i, series := range seriesList {
+			value, ok := row[i+1].(null.Float)
+			if !ok {
+				return nil, errors.New("table column " + table.Columns[i+1].Text + " is not numeric")
+			}
+			series.Points = append(series.Points, tsdb.TimePoint{value, ts})
+		}
+	}
+
+	return seriesList, nil
+}
+
+func (rp *responseParser) nameSeries(seriesList *tsdb.TimeSeriesSlice, target *Query) {
+	set := make(map[string]string)
+	for _, v := range *seriesList {
+		if metricType, exists := v.Tags["metric"]; exists {
+			// Count metrics are told apart by ID as they all share a type
+			if metricType == countType {
+				metricType += v.Tags["metricId"]
+			}
+			if _, ok := set[metricType]; !ok {
+				set[metricType] = ""
+			}
+		}
+	}
+	metricTypeCount := len(set)
+	for _, series := range *seriesList {
+		series.Name = rp.getSeriesName(series, target, metricTypeCount)
+	}
+
+}
+
+var aliasPatternRegex = regexp.MustCompile(`\{\{([\s\S]+?)\}\}`)
+
+func (rp *responseParser) getSeriesName(series *tsdb.TimeSeries, target *Query, metricTypeCount int) string {
+	metricType := series.Tags["metric"]
+	metricName := rp.getMetricName(metricType)
+	delete(series.Tags, "metric")
+
+	metricID := series.Tags["metricId"]
+	delete(series.Tags, "metricId")
+
+	if metricType == countType {
+		for _, metric := range target.Metrics {
+			if metric.ID == metricID {
+				metricName = rp.getCountName(metric, target)
+			}
+		}
+	}
+
+	field := ""
+	if v, ok := series.Tags["field"]; ok {
+		field = v
+		delete(series.Tags, "field")
+	}
+
+	filterQuery, hasFilterQuery := series.Tags["filterQuery"]
+	delete(series.Tags, "filterQuery")
+
+	if target.Alias != "" {
+		resolve := func(group string) (string, bool) {
+			if strings.Index(group, "term ") == 0 {
+				v, ok := series.Tags[group[5:]]
+				return v, ok
+			}
+			if v, ok := series.Tags[group]; ok {
+				return v, true
+			}
+			if group == "metric" {
+				return metricName, true
+			}
+			if group == "field" {
+				return field, field != ""
+			}
+			if group == "filterQuery" {
+				return filterQuery, hasFilterQuery
+			}
+			return "", false
+		}
+
+		// placeholders are resolved against the alias only, so values are never
+		// parsed as placeholders or defaults themselves
+		return aliasPatternRegex.ReplaceAllStringFunc(target.Alias, func(match string) string {
+			group := aliasPatternRegex.FindStringSubmatch(match)[1]
+			if v, ok := resolve(group); ok {
+				return v
+			}
+
+			// {{name:default}} falls back to default when name is absent
+			if i := strings.Index(group, ":"); i > 0 {
+				if v, ok := resolve(group[:i]); ok {
+					return v
+				}
+				return group[i+1:]
+			}
+
+			if group == "field" || strings.Index(group, "term ") == 0 {
+				return ""
+			}
+			return match
+		})
+	}
+	// todo, if field and pipelineAgg
+	// bucket scripts are named after their pipeline variables, which resolve
+	// against all metrics, hidden or not, and need no field
+	if isPipelineAgg(metricType) && (field != "" || isPipelineAggWithMultipleBucketPaths(metricType)) {
+		if isPipelineAggWithMultipleBucketPaths(metricType) {
+			for _, metric := range target.Metrics {
+				if metric.ID == metricID {
+					metricName = metric.Settings.Get("script").MustString()
+					for name, pipelineAgg := range metric.PipelineVariables {
+						for _, m := range target.Metrics {
+							if m.ID == pipelineAgg {
+								metricName = strings.Replace(metricName, "params."+name, describeMetric(m.Type, m.Field), -1)
+							}
+						}
+					}
+				}
+			}
+		} else {
+			found := false
+			for _, metric := range target.Metrics {
+				if metric.ID == field {
+					metricName += " " + describeMetric(metric.Type, field)
+					found = true
+				}
+			}
+			if !found {
+				metricName = "Unset"
+			}
+		}
+	} else if field != "" {
+		metricName += " " + field
+	}
+
+	if len(series.Tags) == 0 {
+		return metricName
+	}
+
+	name := ""
+	for _, v := range series.Tags {
+		name += v + " "
+	}
+
+	if metricTypeCount == 1 {
+		return strings.TrimSpace(name)
+	}
+
+	return strings.TrimSpace(name) + " " + metricName
+
+}
+
+func (rp *responseParser) getMetricName(metric string) string {
+	if text, ok := metricAggType[metric]; ok {
+		return text
+	}
+
+	if text, ok := extendedStats[metric]; ok {
 		return text
 	}
 
+	if strings.HasPrefix(metric, boxplotType+"_") {
+		if text, ok := boxplotStats[strings.TrimPrefix(metric, boxplotType+"_")]; ok {
+			return text
+		}
+	}
+
+	if strings.HasPrefix(metric, matrixStatsType+"_") {
+		if text, ok := matrixStats[strings.TrimPrefix(metric, matrixStatsType+"_")]; ok {
+			return text
+		}
+	}
+
 	return metric
 }
 
+// getCountName returns the name of a count metric. The alias setting of the
+// metric is used when set. Unaliased count metrics are named after their ID
+// if the target has more than one of them.
+func (rp *responseParser) getCountName(metric *MetricAgg, target *Query) string {
+	if alias := metric.Settings.Get("alias").MustString(); alias != "" {
+		return alias
+	}
+
+	unaliased := 0
+	for _, m := range target.Metrics {
+		if m.Type == countType && !m.Hide && m.Settings.Get("alias").MustString() == "" {
+			unaliased++
+		}
+	}
+
+	name := rp.getMetricName(countType)
+	if unaliased > 1 {
+		return name + " " + metric.ID
+	}
+	return name
+}
+
 func castToNullFloat(j *simplejson.Json) null.Float {
 	f, err := j.Float64()
 	if err == nil {
@@ -553,6 +1812,1068 @@ func castToNullFloat(j *simplejson.Json) null.Float {
 	return null.NewFloat(0, false)
 }
 
+// isAllNull returns true if the series has no non-null values.
+func isAllNull(series *tsdb.TimeSeries) bool {
+	for _, point := range series.Points {
+		if point[0].Valid {
+			return false
+		}
+	}
+	return true
+}
+
+// roundToSignificantDigits rounds value to the given number of significant
+// digits. Rounding is relative to the magnitude of the value, so small non-zero
+// values are never rounded to zero.
+func roundToSignificantDigits(value float64, digits int) float64 {
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(value, 'g', digits, 64), 64)
+	if err != nil {
+		return value
+	}
+	return rounded
+}
+
+// alignPoints truncates the timestamps of points sorted by time with align,
+// in the wall clock time of loc so that daily buckets stay on local midnight
+// across daylight saving time changes. The points are left untouched if
+// truncating would give two of them the same timestamp.
+func alignPoints(points tsdb.TimeSeriesPoints, align func(time.Time) time.Time, loc *time.Location) {
+	aligned := make([]float64, len(points))
+	for i, point := range points {
+		t := time.Unix(0, int64(point[1].Float64)*int64(time.Millisecond)).In(loc)
+		aligned[i] = float64(align(t).UnixNano() / int64(time.Millisecond))
+		if i > 0 && aligned[i] == aligned[i-1] {
+			return
+		}
+	}
+
+	for i := range points {
+		points[i][1] = null.FloatFrom(aligned[i])
+	}
+}
+
+// getAlignFunc returns the function truncating a time for the alignInterval
+// setting. A week, month, quarter or year (1w, 1M, 1q or 1y) is truncated to
+// its calendar start, with weeks starting on Monday as in Elasticsearch.
+// Other intervals are fixed durations, truncated to a multiple of the interval
+// since the epoch.
+func getAlignFunc(alignInterval string) (func(time.Time) time.Time, error) {
+	switch alignInterval {
+	case "1w", "1M", "1q", "1y":
+		unit := alignInterval[1]
+		return func(t time.Time) time.Time {
+			year, month, day := t.Date()
+			switch unit {
+			case 'w':
+				day -= (int(t.Weekday()) + 6) % 7
+			case 'M':
+				day = 1
+			case 'q':
+				month, day = month-(month-1)%3, 1
+			default:
+				month, day = time.January, 1
+			}
+			return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+		}, nil
+	}
+
+	// calendar units are only aligned one at a time
+	interval, err := gtime.ParseInterval(alignInterval)
+	if err != nil || interval <= 0 || strings.ContainsAny(alignInterval, "wMqy") {
+		return nil, fmt.Errorf("invalid align interval %q", alignInterval)
+	}
+
+	ms := int64(interval / time.Millisecond)
+	return func(t time.Time) time.Time {
+		_, offset := t.Zone()
+		wall := t.UnixNano()/int64(time.Millisecond) + int64(offset)*1000
+		wall -= ((wall % ms) + ms) % ms
+
+		w := time.Unix(0, wall*int64(time.Millisecond)).UTC()
+		return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), w.Nanosecond(), t.Location())
+	}, nil
+}
+
+// getTimeZoneLocation returns the location of a date histogram time_zone,
+// given either as a zone name or as a UTC offset such as +01:00. UTC is used
+// when no time zone is set.
+func getTimeZoneLocation(timeZone string) (*time.Location, error) {
+	if timeZone == "" {
+		return time.UTC, nil
+	}
+	if t, err := time.Parse("-07:00", timeZone); err == nil {
+		_, offset := t.Zone()
+		return time.FixedZone(timeZone, offset), nil
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q", timeZone)
+	}
+	return loc, nil
+}
+
+// sortPointsByTime sorts points by ascending time. Points sharing a timestamp
+// keep their order, or are summed into a single point if sumDuplicates is set.
+func sortPointsByTime(points tsdb.TimeSeriesPoints, sumDuplicates bool) tsdb.TimeSeriesPoints {
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i][1].Float64 < points[j][1].Float64
+	})
+
+	if !sumDuplicates || len(points) < 2 {
+		return points
+	}
+
+	merged := make(tsdb.TimeSeriesPoints, 0, len(points))
+	for _, point := range points {
+		last := len(merged) - 1
+		if last < 0 || merged[last][1].Float64 != point[1].Float64 {
+			merged = append(merged, point)
+			continue
+		}
+		if point[0].Valid {
+			merged[last][0] = null.FloatFrom(merged[last][0].Float64 + point[0].Float64)
+		}
+	}
+
+	return merged
+}
+
+// getPercentileKeys returns the sorted percentile names of a percentiles
+// aggregation, leaving out the formatted _as_string values.
+func getPercentileKeys(percentiles map[string]interface{}) []string {
+	percentileKeys := make([]string, 0)
+	for k := range percentiles {
+		if strings.HasSuffix(k, "_as_string") {
+			continue
+		}
+		percentileKeys = append(percentileKeys, k)
+	}
+	sort.Strings(percentileKeys)
+	return percentileKeys
+}
+
+// getBucketsPercentileKeys returns the sorted percentile names returned by a
+// percentiles metric across all buckets. When no bucket has any values, the
+// names are derived from the percents configured on the metric so all-null
+// percentiles still produce series.
+func getBucketsPercentileKeys(buckets []interface{}, metric *MetricAgg) []string {
+	percentiles := make(map[string]interface{})
+	for _, v := range buckets {
+		for k, p := range simplejson.NewFromAny(v).GetPath(metric.ID, "values").MustMap() {
+			percentiles[k] = p
+		}
+	}
+
+	if len(percentiles) == 0 {
+		return getSettingsPercentileKeys(metric)
+	}
+	return getPercentileKeys(percentiles)
+}
+
+// getSettingsPercentileKeys returns the percentile names Elasticsearch uses
+// for the percents configured on a metric, falling back to its default
+// percents when none are set.
+func getSettingsPercentileKeys(metric *MetricAgg) []string {
+	percents := metric.Settings.Get("percents").MustArray()
+	if len(percents) == 0 {
+		percents = defaultPercents
+	}
+
+	percentiles := make(map[string]interface{})
+	for _, v := range percents {
+		percent := castToNullFloat(simplejson.NewFromAny(v))
+		if !percent.Valid {
+			continue
+		}
+		// Elasticsearch formats percents as Java doubles, e.g. 50 as "50.0".
+		name := strconv.FormatFloat(percent.Float64, 'f', -1, 64)
+		if percent.Float64 == math.Trunc(percent.Float64) {
+			name = strconv.FormatFloat(percent.Float64, 'f', 1, 64)
+		}
+		percentiles[name] = nil
+	}
+	return getPercentileKeys(percentiles)
+}
+
+// getTimeColumn returns the name of the time column of tables built from the
+// time series of a target.
+func getTimeColumn(target *Query) string {
+	if target.TimeColumn != "" {
+		return target.TimeColumn
+	}
+	return defaultTimeColumn
+}
+
+// getMetricFieldName returns the field a metric is computed over for use in
+// its name. Scripted metrics have no field and fall back to their label
+// setting, then to their script.
+func getMetricFieldName(metric *MetricAgg) string {
+	if metric.Field != "" {
+		return metric.Field
+	}
+
+	if label := metric.Settings.Get("label").MustString(); label != "" {
+		return label
+	}
+
+	script := metric.Settings.Get("script")
+	if inline, err := script.String(); err == nil {
+		return inline
+	}
+	return script.Get("inline").MustString()
+}
+
+// getMetricValue returns a metric value for use as a table value. Values are
+// cast to floats unless the valueType setting of the metric is string, in
+// which case strings are kept as is and numbers are formatted as strings.
+func getMetricValue(metric *MetricAgg, value *simplejson.Json) interface{} {
+	if metric.Settings.Get("valueType").MustString() != valueTypeString {
+		return castToNullFloat(value)
+	}
+
+	switch v := value.Interface().(type) {
+	case nil:
+		return nil
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// getStatsKeys returns the values of a stats metric enabled in its meta, in
+// sorted order. Only the average is returned when none is enabled.
+func getStatsKeys(metric *MetricAgg) []string {
+	keys := make([]string, 0, len(statsStats))
+	for _, statName := range statsStats {
+		if metric.Meta.Get(statName).MustBool(false) {
+			keys = append(keys, statName)
+		}
+	}
+
+	if len(keys) == 0 {
+		keys = append(keys, "avg")
+	}
+	return keys
+}
+
+// getBoxplotStats returns the stats present in a boxplot aggregation, in
+// boxplotStatOrder. Whiskers are left out when Elasticsearch does not return
+// them, as older versions only return the quartiles and min/max.
+func getBoxplotStats(boxplot *simplejson.Json) []string {
+	stats := make([]string, 0, len(boxplotStatOrder))
+	for _, statName := range boxplotStatOrder {
+		if _, ok := boxplot.CheckGet(statName); ok {
+			stats = append(stats, statName)
+		}
+	}
+	return stats
+}
+
+// getTopHitsField returns the single document field a top_hits metric is
+// configured to return, or an empty string if it returns none or several.
+func getTopHitsField(metric *MetricAgg) string {
+	if metric.Field != "" {
+		return metric.Field
+	}
+
+	fields := metric.Settings.Get("fields").MustArray()
+	if len(fields) == 1 {
+		if field, ok := fields[0].(string); ok {
+			return field
+		}
+	}
+
+	return ""
+}
+
+// getTopHitsValue returns the value of field in the first hit of a top_hits
+// aggregation, looking in _source before doc value fields. Returns nil if the
+// bucket has no hits.
+func getTopHitsValue(topHits *simplejson.Json, field string) interface{} {
+	hits := topHits.GetPath("hits", "hits").MustArray()
+	if len(hits) == 0 {
+		return nil
+	}
+
+	hit := simplejson.NewFromAny(hits[0])
+	if value, ok := hit.Get("_source").CheckGet(field); ok {
+		return value.Interface()
+	}
+	if values := hit.GetPath("fields", field).MustArray(); len(values) > 0 {
+		return values[0]
+	}
+
+	return nil
+}
+
+// getBucketKey returns the key of a bucket for use as a table value. The
+// formatted key_as_string is preferred when present, otherwise string keys
+// are kept as is and numeric keys are returned as floats.
+func getBucketKey(bucket *simplejson.Json) interface{} {
+	if key, err := bucket.Get("key_as_string").String(); err == nil {
+		return key
+	}
+	if key, err := bucket.Get("key").String(); err == nil {
+		return key
+	}
+	return castToNullFloat(bucket.Get("key"))
+}
+
+// getRawBucketKey returns the key of a bucket for use as a sortable table
+// value, ignoring its formatted key_as_string.
+func getRawBucketKey(bucket *simplejson.Json) interface{} {
+	if key, err := bucket.Get("key").String(); err == nil {
+		return key
+	}
+	return castToNullFloat(bucket.Get("key"))
+}
+
+// getFormattedBucketKey returns the key_as_string of a bucket, or nil if it
+// has none.
+func getFormattedBucketKey(bucket *simplejson.Json) interface{} {
+	if key, err := bucket.Get("key_as_string").String(); err == nil {
+		return key
+	}
+	return nil
+}
+
+// hasFormattedKeyColumn returns true if table rows of the buckets of an
+// aggregation get their raw key and their formatted key_as_string in separate
+// columns. Buckets without a key_as_string get a nil formatted value, so all
+// rows of a table keep the same columns.
+func hasFormattedKeyColumn(aggDef *BucketAgg) bool {
+	return aggDef.Settings.Get("formattedKeyColumn").MustBool(false)
+}
+
+// getBucketKeyString returns the key of a bucket as a label, preferring the
+// formatted key_as_string when present.
+func getBucketKeyString(bucket *simplejson.Json) (string, bool) {
+	if key, err := bucket.Get("key_as_string").String(); err == nil {
+		return key, true
+	}
+	if key, err := bucket.Get("key").String(); err == nil {
+		return key, true
+	}
+	if key, err := bucket.Get("key").Int64(); err == nil {
+		return strconv.FormatInt(key, 10), true
+	}
+	return "", false
+}
+
+// getBuckets returns the buckets of an aggregation. Keyed aggregations return
+// their buckets as an object, in which case the buckets are returned in key
+// order along with their keys. Keys of anonymous filters, "0", "1" and so on,
+// are ordered numerically so buckets follow the filter definitions. Buckets
+// that are neither an array nor an object, such as missing or null buckets,
+// are treated as no buckets.
+func getBuckets(esAgg *simplejson.Json) ([]*simplejson.Json, []string, bool) {
+	buckets := make([]*simplejson.Json, 0)
+
+	switch b := esAgg.Get("buckets").Interface().(type) {
+	case []interface{}:
+		for _, v := range b {
+			buckets = append(buckets, simplejson.NewFromAny(v))
+		}
+		return buckets, nil, false
+	case map[string]interface{}:
+		keys := make([]string, 0, len(b))
+		for k := range b {
+			keys = append(keys, k)
+		}
+		sortBucketKeys(keys)
+		for _, k := range keys {
+			buckets = append(buckets, simplejson.NewFromAny(b[k]))
+		}
+		return buckets, keys, true
+	}
+
+	return buckets, nil, false
+}
+
+// sortBucketKeys sorts the keys of keyed buckets, numerically if they are all
+// non-negative integers and alphabetically otherwise.
+func sortBucketKeys(keys []string) {
+	indexes := make(map[string]int, len(keys))
+	for _, k := range keys {
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 {
+			sort.Strings(keys)
+			return
+		}
+		indexes[k] = i
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return indexes[keys[i]] < indexes[keys[j]]
+	})
+}
+
+// getHistogramIntKey returns the key of a histogram bucket as an int64 when the
+// histogram has the integerKeys setting. Histograms with a fractional interval
+// and keys that are not whole numbers are left to the float handling.
+func getHistogramIntKey(aggDef *BucketAgg, bucket *simplejson.Json) (int64, bool) {
+	if aggDef.Type != histogramType || !aggDef.Settings.Get("integerKeys").MustBool(false) {
+		return 0, false
+	}
+
+	interval := aggDef.Settings.Get("interval")
+	if s, err := interval.String(); err == nil {
+		if v, err := strconv.ParseFloat(s, 64); err != nil || v != math.Trunc(v) {
+			return 0, false
+		}
+	} else if v, err := interval.Float64(); err == nil && v != math.Trunc(v) {
+		return 0, false
+	}
+
+	key := castToNullFloat(bucket.Get("key"))
+	if !key.Valid || key.Float64 != math.Trunc(key.Float64) {
+		return 0, false
+	}
+	return int64(key.Float64), true
+}
+
+// getTablePropKeys returns the sorted props of a bucket that become table
+// columns, including typed values that have no series tag such as formatted
+// keys. The filterQuery prop is only used to resolve series aliases.
+func getTablePropKeys(props map[string]string, propValues map[string]interface{}) []string {
+	propKeys := make([]string, 0, len(props))
+	for k := range props {
+		if k == "filterQuery" {
+			continue
+		}
+		propKeys = append(propKeys, k)
+	}
+	for k := range propValues {
+		if _, ok := props[k]; !ok {
+			propKeys = append(propKeys, k)
+		}
+	}
+	sort.Strings(propKeys)
+	return propKeys
+}
+
+// getPropValue returns the typed value of a prop, falling back to its string
+// form when no typed value was recorded.
+func getPropValue(props map[string]string, propValues map[string]interface{}, key string) interface{} {
+	if value, ok := propValues[key]; ok {
+		return value
+	}
+	return props[key]
+}
+
+// getFilterLabel returns the label of a filter definition of a filters bucket
+// aggregation, falling back to its query as the query builder does.
+func getFilterLabel(filter *simplejson.Json) string {
+	label := filter.Get("label").MustString()
+	if label == "" {
+		label = filter.Get("query").MustString()
+	}
+	return label
+}
+
+// getFilterBucketLabel returns the label and query of the i-th bucket of a
+// filters aggregation returning its buckets as an array, which happens for
+// anonymous filters and follows the order of the filter definitions. Buckets
+// without a defined filter, or whose filter has neither label nor query, are
+// labeled by position. ok is false if the bucket has no filter definition.
+func getFilterBucketLabel(aggDef *BucketAgg, i int) (label, query string, ok bool) {
+	filters := aggDef.Settings.Get("filters")
+	if i >= len(filters.MustArray()) {
+		return strconv.Itoa(i), "", false
+	}
+
+	filter := filters.GetIndex(i)
+	label = getFilterLabel(filter)
+	if label == "" {
+		label = strconv.Itoa(i)
+	}
+	return label, filter.Get("query").MustString(), true
+}
+
+// getFilterQuery returns the configured query of the filter definition that
+// produced the bucket with the given key.
+func getFilterQuery(aggDef *BucketAgg, bucketKey string) (string, bool) {
+	for _, f := range aggDef.Settings.Get("filters").MustArray() {
+		filter := simplejson.NewFromAny(f)
+		if getFilterLabel(filter) == bucketKey {
+			return filter.Get("query").MustString(), true
+		}
+	}
+	return "", false
+}
+
+// getCompositeSources returns the source names of a composite aggregation, in
+// the order of the sources setting or else sorted by name from the key of the
+// bucket.
+func getCompositeSources(aggDef *BucketAgg, bucket *simplejson.Json) []string {
+	sources := make([]string, 0)
+	for _, s := range aggDef.Settings.Get("sources").MustArray() {
+		for name := range simplejson.NewFromAny(s).MustMap() {
+			sources = append(sources, name)
+		}
+	}
+	if len(sources) > 0 {
+		return sources
+	}
+
+	for name := range bucket.Get("key").MustMap() {
+		sources = append(sources, name)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// getCompositeValue returns the value of a source in the key of a composite
+// bucket as a label. Numbers, such as the keys of date_histogram sources, are
+// formatted without an exponent.
+func getCompositeValue(aggDef *BucketAgg, bucket *simplejson.Json, source string) string {
+	switch v := getCompositeTypedValue(aggDef, bucket, source).(type) {
+	case string:
+		return v
+	case null.Float:
+		return strconv.FormatFloat(v.Float64, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// getCompositeTypedValue returns the value of a source in the key of a
+// composite bucket for use as a table value, keeping numbers as floats. Null
+// values, from documents missing the source field, are labeled with the
+// missingLabel setting, (missing) by default.
+func getCompositeTypedValue(aggDef *BucketAgg, bucket *simplejson.Json, source string) interface{} {
+	switch v := bucket.GetPath("key", source).Interface().(type) {
+	case nil:
+		return aggDef.Settings.Get("missingLabel").MustString(defaultCompositeMissingLabel)
+	case float64:
+		return null.FloatFrom(v)
+	default:
+		return v
+	}
+}
+
+// getIPRangeLabel returns a readable label for an ip_range bucket. CIDR mask
+// buckets keep their mask as label, other buckets are labeled from their
+// from/to bounds where an open end is shown as *.
+func getIPRangeLabel(bucket *simplejson.Json) string {
+	key := bucket.Get("key").MustString()
+	if strings.Contains(key, "/") {
+		return key
+	}
+
+	from := bucket.Get("from").MustString()
+	to := bucket.Get("to").MustString()
+	if from == "" && to == "" {
+		return key
+	}
+	if from == "" {
+		from = "*"
+	}
+	if to == "" {
+		to = "*"
+	}
+
+	return from + " - " + to
+}
+
+// getGeotileColumns returns the names of the columns a geotile_grid bucket is
+// decoded to: the tile center and, with the bounds setting, the tile bounds.
+func getGeotileColumns(aggDef *BucketAgg) []string {
+	columns := []string{"lat", "lon"}
+	if aggDef.Settings.Get("bounds").MustBool(false) {
+		columns = append(columns, "top", "left", "bottom", "right")
+	}
+	return columns
+}
+
+// getGeotileValues decodes a geotile_grid bucket key of the form zoom/x/y to
+// the values of the columns returned by getGeotileColumns. All values are null
+// for keys that are not a valid tile.
+func getGeotileValues(key string, aggDef *BucketAgg) tsdb.RowValues {
+	columns := getGeotileColumns(aggDef)
+	values := make(tsdb.RowValues, len(columns))
+
+	z, x, y, ok := parseGeotileKey(key)
+	if !ok {
+		for i := range values {
+			values[i] = null.NewFloat(0, false)
+		}
+		return values
+	}
+
+	// the center latitude is not the mean of the bounds in web mercator
+	n := math.Exp2(float64(z))
+	values[0] = null.FloatFrom(tileToLat(float64(y)+0.5, n))
+	values[1] = null.FloatFrom(tileToLon(float64(x)+0.5, n))
+	if len(values) > 2 {
+		values[2] = null.FloatFrom(tileToLat(float64(y), n))
+		values[3] = null.FloatFrom(tileToLon(float64(x), n))
+		values[4] = null.FloatFrom(tileToLat(float64(y+1), n))
+		values[5] = null.FloatFrom(tileToLon(float64(x+1), n))
+	}
+
+	return values
+}
+
+// parseGeotileKey parses a zoom/x/y tile key. Zoom levels are limited to the
+// 0-29 range supported by Elasticsearch and x and y must lie within the grid.
+func parseGeotileKey(key string) (z, x, y int64, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 {
+		return 0, 0, 0, false
+	}
+
+	coords := make([]int64, 3)
+	for i, part := range parts {
+		v, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || v < 0 {
+			return 0, 0, 0, false
+		}
+		coords[i] = v
+	}
+
+	z, x, y = coords[0], coords[1], coords[2]
+	if z > 29 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return 0, 0, 0, false
+	}
+
+	return z, x, y, true
+}
+
+func tileToLon(x, n float64) float64 {
+	return x/n*360 - 180
+}
+
+func tileToLat(y, n float64) float64 {
+	return math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi
+}
+
+// getRawBucket returns the JSON encoding of a bucket, truncated to
+// maxRawBucketSize bytes.
+func getRawBucket(bucket *simplejson.Json) string {
+	data, err := bucket.Encode()
+	if err != nil {
+		return ""
+	}
+	if len(data) > maxRawBucketSize {
+		return string(data[:maxRawBucketSize]) + "..."
+	}
+	return string(data)
+}
+
+// isHeatmapQuery returns true if the target is a date histogram with a single
+// nested histogram, the only bucket aggregation layout supported by the
+// heatmap output.
+func isHeatmapQuery(target *Query) bool {
+	return len(target.BucketAggs) == 2 &&
+		target.BucketAggs[0].Type == dateHistType &&
+		target.BucketAggs[1].Type == histogramType
+}
+
+// findGeoLineMetric returns the first visible geo_line metric of the target.
+func findGeoLineMetric(target *Query) *MetricAgg {
+	for _, metric := range target.Metrics {
+		if metric.Type == geoLineType && !metric.Hide {
+			return metric
+		}
+	}
+	return nil
+}
+
+// findMatrixStatsMetric returns the first visible matrix_stats metric of the
+// target.
+func findMatrixStatsMetric(target *Query) *MetricAgg {
+	for _, metric := range target.Metrics {
+		if metric.Type == matrixStatsType && !metric.Hide {
+			return metric
+		}
+	}
+	return nil
+}
+
+// getMatrixStatsFields returns the fields of a matrix_stats metric, as
+// configured in its fields setting or else as returned in the aggregation.
+func getMatrixStatsFields(metric *MetricAgg, matrix *simplejson.Json) []string {
+	fields := make([]string, 0)
+	for _, f := range metric.Settings.Get("fields").MustArray() {
+		if field, ok := f.(string); ok {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) > 0 {
+		return fields
+	}
+
+	for _, f := range matrix.Get("fields").MustArray() {
+		if name := simplejson.NewFromAny(f).Get("name").MustString(); name != "" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// getMatrixStatsField returns the stats of a field in a matrix_stats
+// aggregation. Fields without enough data to compute stats are missing from
+// the aggregation and yield empty stats.
+func getMatrixStatsField(matrix *simplejson.Json, field string) *simplejson.Json {
+	for _, f := range matrix.Get("fields").MustArray() {
+		stats := simplejson.NewFromAny(f)
+		if stats.Get("name").MustString() == field {
+			return stats
+		}
+	}
+	return simplejson.New()
+}
+
+// addExecutionHintMeta records the execution hint of a terms aggregation in the
+// query result meta, as it affects the doc count error of the terms. Terms
+// without a configured hint are recorded as default.
+func addExecutionHintMeta(queryRes *tsdb.QueryResult, aggDef *BucketAgg) {
+	hint := aggDef.Settings.Get("execution_hint").MustString()
+	if hint == "" {
+		hint = "default"
+	}
+	getQueryResultMeta(queryRes).SetPath([]string{"executionHints", aggDef.ID}, hint)
+}
+
+// addCollectModeMeta records the collect mode of a terms aggregation in the
+// query result meta, as breadth_first changes how nested aggregations are
+// computed. Terms without a configured mode are recorded as depth_first, the
+// Elasticsearch default.
+func addCollectModeMeta(queryRes *tsdb.QueryResult, aggDef *BucketAgg) {
+	mode := aggDef.Settings.Get("collect_mode").MustString("depth_first")
+	getQueryResultMeta(queryRes).SetPath([]string{"collectModes", aggDef.ID}, mode)
+}
+
+// addTermsFilterMeta adds the include/exclude filters of a terms aggregation
+// to the query result meta, together with the number of documents that fell
+// outside the returned terms. Nothing is added if no filter is configured.
+func addTermsFilterMeta(queryRes *tsdb.QueryResult, aggDef *BucketAgg, esAgg *simplejson.Json) {
+	include, hasInclude := aggDef.Settings.CheckGet("include")
+	exclude, hasExclude := aggDef.Settings.CheckGet("exclude")
+	if !hasInclude && !hasExclude {
+		return
+	}
+
+	meta := getQueryResultMeta(queryRes)
+	filter := meta.GetPath("termsFilters", aggDef.ID)
+	if _, err := filter.Map(); err != nil {
+		filter = simplejson.New()
+		if hasInclude {
+			filter.Set("include", include.Interface())
+		}
+		if hasExclude {
+			filter.Set("exclude", exclude.Interface())
+		}
+		meta.SetPath([]string{"termsFilters", aggDef.ID}, filter.Interface())
+		filter = meta.GetPath("termsFilters", aggDef.ID)
+	}
+
+	if sumOther, err := esAgg.Get("sum_other_doc_count").Int64(); err == nil {
+		filter.Set("sumOtherDocCount", filter.Get("sumOtherDocCount").MustInt64()+sumOther)
+	}
+}
+
+type profileEntry struct {
+	Name        string `json:"name"`
+	TimeInNanos int64  `json:"timeInNanos"`
+}
+
+// summarizeProfile reduces the profile of a search response to the total time
+// and the slowest shards and queries, since the full profile can be very large.
+func summarizeProfile(profile *simplejson.Json) map[string]interface{} {
+	shards := make([]profileEntry, 0)
+	queries := make([]profileEntry, 0)
+	var total int64
+
+	for _, s := range profile.Get("shards").MustArray() {
+		shard := simplejson.NewFromAny(s)
+		var shardTime int64
+		for _, search := range shard.Get("searches").MustArray() {
+			for _, q := range simplejson.NewFromAny(search).Get("query").MustArray() {
+				query := simplejson.NewFromAny(q)
+				queryTime := query.Get("time_in_nanos").MustInt64()
+				shardTime += queryTime
+				queries = append(queries, profileEntry{
+					Name:        query.Get("type").MustString() + " " + query.Get("description").MustString(),
+					TimeInNanos: queryTime,
+				})
+			}
+		}
+		for _, a := range shard.Get("aggregations").MustArray() {
+			shardTime += simplejson.NewFromAny(a).Get("time_in_nanos").MustInt64()
+		}
+		total += shardTime
+		shards = append(shards, profileEntry{Name: shard.Get("id").MustString(), TimeInNanos: shardTime})
+	}
+
+	slowest := func(entries []profileEntry) []profileEntry {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].TimeInNanos > entries[j].TimeInNanos
+		})
+		if len(entries) > maxProfileEntries {
+			entries = entries[:maxProfileEntries]
+		}
+		return entries
+	}
+
+	return map[string]interface{}{
+		"shardCount":     len(shards),
+		"totalTimeNanos": total,
+		"slowestShards":  slowest(shards),
+		"slowestQueries": slowest(queries),
+	}
+}
+
+// addPercentilesMethodMeta records in the query result meta which method each
+// percentiles metric of the target is computed with, as Elasticsearch does not
+// return it. Metrics without hdr settings use the default t-digest method.
+func addPercentilesMethodMeta(queryRes *tsdb.QueryResult, target *Query) {
+	for _, metric := range target.Metrics {
+		if metric.Type != percentilesType || metric.Hide {
+			continue
+		}
+
+		method := "tdigest"
+		if _, ok := metric.Settings.CheckGet("hdr"); ok {
+			method = "hdr"
+		}
+		getQueryResultMeta(queryRes).SetPath([]string{"percentilesMethod", metric.ID}, method)
+	}
+}
+
+// addMissingValueMeta records in the query result meta the missing value each
+// metric of the target substitutes for documents without the field, so that
+// results including substituted values can be told apart. Metrics without a
+// missing setting are left out.
+func addMissingValueMeta(queryRes *tsdb.QueryResult, target *Query) {
+	for _, metric := range target.Metrics {
+		if metric.Hide {
+			continue
+		}
+
+		if missing, ok := metric.Settings.CheckGet("missing"); ok {
+			getQueryResultMeta(queryRes).SetPath([]string{"missingValues", metric.ID}, missing.Interface())
+		}
+	}
+}
+
+// addWeightedAvgMissingMeta records in the query result meta the missing values
+// of the value and weight sources of each weighted_avg metric of the target.
+// Sources without a missing setting are left out.
+func addWeightedAvgMissingMeta(queryRes *tsdb.QueryResult, target *Query) {
+	for _, metric := range target.Metrics {
+		if metric.Type != weightedAvgType || metric.Hide {
+			continue
+		}
+
+		for _, source := range []string{"value", "weight"} {
+			if missing, ok := metric.Settings.Get(source).CheckGet("missing"); ok {
+				getQueryResultMeta(queryRes).SetPath([]string{"weightedAvgMissing", metric.ID, source}, missing.Interface())
+			}
+		}
+	}
+}
+
+// addBucketSelectorMeta records in the query result meta the IDs of the
+// bucket_selector metrics of the target, as the buckets they drop show up as
+// gaps in the results.
+func addBucketSelectorMeta(queryRes *tsdb.QueryResult, target *Query) {
+	ids := make([]interface{}, 0)
+	for _, metric := range target.Metrics {
+		if metric.Type == bucketSelectorType {
+			ids = append(ids, metric.ID)
+		}
+	}
+
+	if len(ids) > 0 {
+		getQueryResultMeta(queryRes).Set("bucketSelectors", ids)
+	}
+}
+
+// hasBucketSelector returns true if the target has a bucket_selector metric.
+func hasBucketSelector(target *Query) bool {
+	for _, metric := range target.Metrics {
+		if metric.Type == bucketSelectorType {
+			return true
+		}
+	}
+	return false
+}
+
+// addEffectiveTimeRangeMeta records in the query result meta the earliest and
+// latest timestamps of the series, in epoch milliseconds. Nothing is added if
+// the result has no timestamps, as for tables built from non time buckets.
+func addEffectiveTimeRangeMeta(queryRes *tsdb.QueryResult) {
+	from, to := math.Inf(1), math.Inf(-1)
+	for _, series := range queryRes.Series {
+		for _, point := range series.Points {
+			if !point[1].Valid {
+				continue
+			}
+			from = math.Min(from, point[1].Float64)
+			to = math.Max(to, point[1].Float64)
+		}
+	}
+
+	if from > to {
+		return
+	}
+	meta := getQueryResultMeta(queryRes)
+	meta.SetPath([]string{"effectiveTimeRange", "from"}, from)
+	meta.SetPath([]string{"effectiveTimeRange", "to"}, to)
+}
+
+// addHitsTotalMeta records the number of documents matched by the search in
+// the query result meta. Elasticsearch 7 returns the total as an object with a
+// relation, which is gte when the count is a lower bound, while older versions
+// return an exact count.
+func addHitsTotalMeta(queryRes *tsdb.QueryResult, total *simplejson.Json) {
+	meta := getQueryResultMeta(queryRes)
+	if value, err := total.Int64(); err == nil {
+		meta.Set("hitsTotal", value)
+		meta.Set("hitsTotalRelation", "eq")
+		return
+	}
+
+	if value, err := total.Get("value").Int64(); err == nil {
+		meta.Set("hitsTotal", value)
+		meta.Set("hitsTotalRelation", total.Get("relation").MustString("eq"))
+	}
+}
+
+// getQueryResultMeta returns the meta of the query result as a JSON object,
+// creating it or converting existing debug info when needed.
+func getQueryResultMeta(queryRes *tsdb.QueryResult) *simplejson.Json {
+	if queryRes.Meta == nil {
+		queryRes.Meta = simplejson.New()
+	} else if _, err := queryRes.Meta.Map(); err != nil {
+		meta := simplejson.New()
+		if data, err := queryRes.Meta.Encode(); err == nil {
+			if m, err := simplejson.NewJson(data); err == nil {
+				meta = m
+			}
+		}
+		queryRes.Meta = meta
+	}
+
+	return queryRes.Meta
+}
+
+// addMetaNotice appends a notice to the notices list of the query result meta.
+func addMetaNotice(queryRes *tsdb.QueryResult, notice string) {
+	meta := getQueryResultMeta(queryRes)
+	notices := meta.Get("notices").MustArray()
+	meta.Set("notices", append(notices, notice))
+}
+
+// checkBuckets removes the buckets of esAgg that are not objects when the
+// target has lenient parsing, adding a notice to the query result for each of
+// them so the remaining buckets are still parsed. Buckets that are neither an
+// array nor an object can't be parsed at all and return an error. Without
+// lenient parsing the buckets are left as is.
+func checkBuckets(esAgg *simplejson.Json, aggDef *BucketAgg, target *Query, queryRes *tsdb.QueryResult) error {
+	if !target.LenientParsing {
+		return nil
+	}
+
+	skip := func(key interface{}) {
+		addMetaNotice(queryRes, fmt.Sprintf("skipped bucket %v of aggregation %s, bucket is not an object", key, aggDef.ID))
+	}
+
+	switch buckets := esAgg.Get("buckets").Interface().(type) {
+	case nil:
+	case []interface{}:
+		kept := make([]interface{}, 0, len(buckets))
+		for i, b := range buckets {
+			if _, ok := b.(map[string]interface{}); ok {
+				kept = append(kept, b)
+			} else {
+				skip(i)
+			}
+		}
+		if len(kept) < len(buckets) {
+			esAgg.Set("buckets", kept)
+		}
+	case map[string]interface{}:
+		for key, b := range buckets {
+			if _, ok := b.(map[string]interface{}); !ok {
+				skip(key)
+				delete(buckets, key)
+			}
+		}
+	default:
+		return &structuralError{fmt.Sprintf("buckets of aggregation %s are neither an array nor an object", aggDef.ID)}
+	}
+	return nil
+}
+
+// structuralError is an error in the structure of a response, such as
+// buckets that are neither an array nor an object. It fails the target even
+// with lenient parsing.
+type structuralError struct {
+	msg string
+}
+
+func (e *structuralError) Error() string {
+	return e.msg
+}
+
+// isSamplerAgg returns true for the single bucket sampler aggregations, whose
+// nested aggregations are processed as if the sampler was not there.
+func isSamplerAgg(aggDef *BucketAgg) bool {
+	return aggDef.Type == samplerType || aggDef.Type == diversifiedSamplerType
+}
+
+// addDiversifiedSamplerMeta adds the dedup settings of a diversified_sampler
+// aggregation to the query result meta, keyed by aggregation ID.
+func addDiversifiedSamplerMeta(queryRes *tsdb.QueryResult, aggDef *BucketAgg) {
+	meta := getQueryResultMeta(queryRes)
+	if _, exists := meta.Get("diversifiedSampler").CheckGet(aggDef.ID); exists {
+		return
+	}
+
+	meta.SetPath([]string{"diversifiedSampler", aggDef.ID}, map[string]interface{}{
+		"field":              aggDef.Field,
+		"max_docs_per_value": aggDef.Settings.Get("max_docs_per_value").MustInt64(1),
+	})
+}
+
+// getRowLimit returns how many of n new rows fit within the MaxRows limit of
+// the target, given the rows already produced. A notice is added to the query
+// result the first time rows are dropped.
+func getRowLimit(target *Query, queryRes *tsdb.QueryResult, produced, n int) int {
+	if target.MaxRows <= 0 || produced+n <= target.MaxRows {
+		return n
+	}
+
+	meta := getQueryResultMeta(queryRes)
+	if !meta.Get("truncated").MustBool(false) {
+		meta.Set("truncated", true)
+		addMetaNotice(queryRes, fmt.Sprintf("the result exceeds the limit of %d rows and was truncated", target.MaxRows))
+	}
+
+	if produced >= target.MaxRows {
+		return 0
+	}
+	return target.MaxRows - produced
+}
+
+// validateBucketAggIDs returns an error if two bucket aggregations of the
+// target share an ID. Metrics may share IDs with bucket aggregations.
+func validateBucketAggIDs(target *Query) error {
+	ids := make(map[string]bool)
+	for _, bucketAgg := range target.BucketAggs {
+		if ids[bucketAgg.ID] {
+			return fmt.Errorf("query %s has more than one bucket aggregation with id %s", target.RefID, bucketAgg.ID)
+		}
+		ids[bucketAgg.ID] = true
+	}
+	return nil
+}
+
 func findAgg(target *Query, aggID string) (*BucketAgg, error) {
 	for _, v := range target.BucketAggs {
 		if aggID == v.ID {
@@ -3,6 +3,8 @@ package elasticsearch
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -865,6 +867,5189 @@ func TestResponseParser(t *testing.T) {
 			So(seriesThree.Points[1][1].Float64, ShouldEqual, 2000)
 		})
 
+		Convey("Wide output with multiple metrics", func() {
+			query := `{
+				"timeField": "@timestamp",
+				"metrics": [{ "type": "count", "id": "1" }, { "type": "avg", "field": "value", "id": "2" }],
+				"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "3" }]%s
+			}`
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "3": {
+                "buckets": [
+                  {
+                    "2": { "value": 88 },
+                    "doc_count": 10,
+                    "key": 1000
+                  },
+                  {
+                    "doc_count": 15,
+                    "key": 2000
+                  },
+                  {
+                    "2": { "value": 77 },
+                    "doc_count": 5,
+                    "key": 3000
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(map[string]string{"A": fmt.Sprintf(query, "")}, response)
+			So(err, ShouldBeNil)
+			longResult, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			rp, err = newResponseParserForTest(map[string]string{"A": fmt.Sprintf(query, `, "output": "wide"`)}, response)
+			So(err, ShouldBeNil)
+			wideResult, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			longRes := longResult.Results["A"]
+			So(longRes.Series, ShouldHaveLength, 2)
+			So(longRes.Series[0].Points, ShouldHaveLength, 3)
+			So(longRes.Series[1].Points, ShouldHaveLength, 2)
+
+			wideRes := wideResult.Results["A"]
+			So(wideRes.Series, ShouldHaveLength, 0)
+			So(wideRes.Tables, ShouldHaveLength, 1)
+
+			cols := wideRes.Tables[0].Columns
+			So(cols, ShouldHaveLength, 3)
+			So(cols[0].Text, ShouldEqual, "Time")
+			So(cols[1].Text, ShouldEqual, longRes.Series[0].Name)
+			So(cols[2].Text, ShouldEqual, longRes.Series[1].Name)
+
+			rows := wideRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 3)
+			So(rows[0][0].(null.Float).Float64, ShouldEqual, 1000)
+			So(rows[0][1].(null.Float).Float64, ShouldEqual, 10)
+			So(rows[0][2].(null.Float).Float64, ShouldEqual, 88)
+			So(rows[1][0].(null.Float).Float64, ShouldEqual, 2000)
+			So(rows[1][1].(null.Float).Float64, ShouldEqual, 15)
+			So(rows[1][2].(null.Float).Valid, ShouldBeFalse)
+			So(rows[2][0].(null.Float).Float64, ShouldEqual, 3000)
+			So(rows[2][1].(null.Float).Float64, ShouldEqual, 5)
+			So(rows[2][2].(null.Float).Float64, ShouldEqual, 77)
+		})
+
+		Convey("IP range response", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "ip_range", "field": "ip", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "key": "*-10.0.0.5", "to": "10.0.0.5", "doc_count": 10 },
+                  { "key": "10.0.0.5-10.0.0.127", "from": "10.0.0.5", "to": "10.0.0.127", "doc_count": 5 },
+                  { "key": "10.0.0.127-*", "from": "10.0.0.127", "doc_count": 3 },
+                  { "key": "10.0.0.0/25", "from": "10.0.0.0", "to": "10.0.0.128", "doc_count": 127 },
+                  { "key": "::1-::ff", "from": "::1", "to": "::ff", "doc_count": 2 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+			So(result.Results, ShouldHaveLength, 1)
+
+			queryRes := result.Results["A"]
+			So(queryRes, ShouldNotBeNil)
+			So(queryRes.Tables, ShouldHaveLength, 1)
+
+			rows := queryRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 5)
+			cols := queryRes.Tables[0].Columns
+			So(cols, ShouldHaveLength, 2)
+			So(cols[0].Text, ShouldEqual, "ip")
+			So(cols[1].Text, ShouldEqual, "Count")
+
+			So(rows[0][0].(string), ShouldEqual, "* - 10.0.0.5")
+			So(rows[0][1].(null.Float).Float64, ShouldEqual, 10)
+			So(rows[1][0].(string), ShouldEqual, "10.0.0.5 - 10.0.0.127")
+			So(rows[2][0].(string), ShouldEqual, "10.0.0.127 - *")
+			So(rows[3][0].(string), ShouldEqual, "10.0.0.0/25")
+			So(rows[3][1].(null.Float).Float64, ShouldEqual, 127)
+			So(rows[4][0].(string), ShouldEqual, "::1 - ::ff")
+		})
+
+		Convey("IP range CIDR group by with date histogram", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "ip_range", "field": "ip", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] },
+                    "key": "10.0.0.0/25",
+                    "from": "10.0.0.0",
+                    "to": "10.0.0.128",
+                    "doc_count": 1
+                  },
+                  {
+                    "3": { "buckets": [{ "doc_count": 2, "key": 1000 }] },
+                    "key": "10.0.0.5-*",
+                    "from": "10.0.0.5",
+                    "doc_count": 2
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes, ShouldNotBeNil)
+			So(queryRes.Series, ShouldHaveLength, 2)
+			So(queryRes.Series[0].Name, ShouldEqual, "10.0.0.0/25")
+			So(queryRes.Series[1].Name, ShouldEqual, "10.0.0.5 - *")
+		})
+
+		Convey("Terms table with top_hits field", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [
+						{ "type": "count", "id": "1" },
+						{ "type": "top_hits", "id": "3", "settings": { "size": 1, "fields": ["message"] } }
+					],
+					"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "hits": { "total": 369, "hits": [{ "_source": { "message": "hello" } }] } },
+                    "key": "server-1",
+                    "doc_count": 369
+                  },
+                  {
+                    "3": { "hits": { "total": 0, "hits": [] } },
+                    "key": "server-2",
+                    "doc_count": 0
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+			So(result.Results, ShouldHaveLength, 1)
+
+			queryRes := result.Results["A"]
+			So(queryRes, ShouldNotBeNil)
+			So(queryRes.Tables, ShouldHaveLength, 1)
+
+			cols := queryRes.Tables[0].Columns
+			So(cols, ShouldHaveLength, 3)
+			So(cols[0].Text, ShouldEqual, "host")
+			So(cols[1].Text, ShouldEqual, "Count")
+			So(cols[2].Text, ShouldEqual, "message")
+
+			rows := queryRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 2)
+			So(rows[0][0].(string), ShouldEqual, "server-1")
+			So(rows[0][1].(null.Float).Float64, ShouldEqual, 369)
+			So(rows[0][2].(string), ShouldEqual, "hello")
+			So(rows[1][0].(string), ShouldEqual, "server-2")
+			So(rows[1][2], ShouldBeNil)
+		})
+
+		Convey("With trimEdges larger than the returned data", func() {
+			query := `{
+				"timeField": "@timestamp",
+				"metrics": [{ "type": "count", "id": "1" }],
+				"bucketAggs": [
+					{ "type": "date_histogram", "field": "@timestamp", "id": "2", "settings": { "trimEdges": %d } }
+				]
+			}`
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "key": 1, "doc_count": 369 },
+                  { "key": 2, "doc_count": 200 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			for _, trimEdges := range []int{1, 5} {
+				rp, err := newResponseParserForTest(map[string]string{"A": fmt.Sprintf(query, trimEdges)}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes, ShouldNotBeNil)
+				So(queryRes.Series, ShouldHaveLength, 1)
+				So(queryRes.Series[0].Points, ShouldHaveLength, 2)
+				So(queryRes.Meta, ShouldNotBeNil)
+				notices := queryRes.Meta.Get("notices").MustArray()
+				So(notices, ShouldHaveLength, 1)
+				So(notices[0], ShouldContainSubstring, "trimEdges")
+			}
+		})
+
+		Convey("Terms with geo_line metric", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "geo_line", "field": "location", "id": "1", "settings": { "sort": { "field": "@timestamp" } } }],
+					"bucketAggs": [{ "type": "terms", "field": "vehicle", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "1": {
+                      "type": "Feature",
+                      "geometry": { "type": "LineString", "coordinates": [[4.9, 52.3], [4.91, 52.31]] },
+                      "properties": { "complete": true }
+                    },
+                    "key": "bus-1",
+                    "doc_count": 2
+                  },
+                  {
+                    "1": {
+                      "type": "Feature",
+                      "geometry": { "type": "LineString", "coordinates": [[2.35, 48.85]] },
+                      "properties": { "complete": false }
+                    },
+                    "key": "bus-2",
+                    "doc_count": 10
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes, ShouldNotBeNil)
+			So(queryRes.Tables, ShouldHaveLength, 1)
+
+			cols := queryRes.Tables[0].Columns
+			So(cols, ShouldHaveLength, 3)
+			So(cols[0].Text, ShouldEqual, "vehicle")
+			So(cols[1].Text, ShouldEqual, "lat")
+			So(cols[2].Text, ShouldEqual, "lon")
+
+			rows := queryRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 3)
+			So(rows[0][0].(string), ShouldEqual, "bus-1")
+			So(rows[0][1].(null.Float).Float64, ShouldEqual, 52.3)
+			So(rows[0][2].(null.Float).Float64, ShouldEqual, 4.9)
+			So(rows[1][0].(string), ShouldEqual, "bus-1")
+			So(rows[1][1].(null.Float).Float64, ShouldEqual, 52.31)
+			So(rows[2][0].(string), ShouldEqual, "bus-2")
+			So(rows[2][2].(null.Float).Float64, ShouldEqual, 2.35)
+
+			So(queryRes.Meta.Get("geoLineTruncated").MustBool(), ShouldBeTrue)
+		})
+
+		Convey("With raw buckets enabled", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"rawBuckets": true,
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+				}`,
+				"B": `{
+					"timeField": "@timestamp",
+					"rawBuckets": true,
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [{ "key": "server-1", "doc_count": 369 }]
+              }
+            }
+          }
+        ]
+			}`
+
+			rp, err := newResponseParserForTest(map[string]string{"A": targets["A"]}, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Tables, ShouldHaveLength, 1)
+			cols := queryRes.Tables[0].Columns
+			So(cols, ShouldHaveLength, 3)
+			So(cols[2].Text, ShouldEqual, "Raw")
+			rows := queryRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 1)
+			So(rows[0][2].(string), ShouldEqual, `{"doc_count":369,"key":"server-1"}`)
+
+			response = `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [{ "key": 1000, "doc_count": 10 }]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err = newResponseParserForTest(map[string]string{"B": targets["B"]}, response)
+			So(err, ShouldBeNil)
+			result, err = rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes = result.Results["B"]
+			So(queryRes.Series, ShouldHaveLength, 1)
+			rawBuckets := queryRes.Meta.Get("rawBuckets").MustArray()
+			So(rawBuckets, ShouldHaveLength, 1)
+			So(rawBuckets[0], ShouldEqual, `{"doc_count":10,"key":1000}`)
+		})
+
+		Convey("Histogram response with key_as_string", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "histogram", "field": "bytes", "id": "3" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "3": {
+                "buckets": [
+                  { "doc_count": 1, "key": 1000, "key_as_string": "1 kB" },
+                  { "doc_count": 3, "key": 2000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Tables, ShouldHaveLength, 1)
+			rows := queryRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 2)
+			So(rows[0][0].(string), ShouldEqual, "1 kB")
+			So(rows[1][0].(null.Float).Float64, ShouldEqual, 2000)
+		})
+
+		Convey("Histogram group by with key_as_string and date histogram", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "histogram", "field": "bytes", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": {
+                      "buckets": [{ "doc_count": 1, "key": 1000, "key_as_string": "1970-01-01T00:00:01.000Z" }]
+                    },
+                    "key": 1000,
+                    "key_as_string": "1 kB",
+                    "doc_count": 1
+                  },
+                  {
+                    "3": {
+                      "buckets": [{ "doc_count": 2, "key": 1000, "key_as_string": "1970-01-01T00:00:01.000Z" }]
+                    },
+                    "key": 2000,
+                    "doc_count": 2
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+			So(queryRes.Series[0].Name, ShouldEqual, "1 kB")
+			So(queryRes.Series[0].Points[0][1].Float64, ShouldEqual, 1000)
+			So(queryRes.Series[1].Name, ShouldEqual, "2000")
+			So(queryRes.Series[1].Points[0][1].Float64, ShouldEqual, 1000)
+		})
+
+		Convey("With error response", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "error": {
+              "root_cause": [{ "type": "parse_exception", "reason": "failed to parse query" }],
+              "reason": "all shards failed"
+            }
+          }
+        ]
+			}`
+
+			Convey("Should record an error result by default", func() {
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results, ShouldHaveLength, 1)
+				So(result.Results["A"].ErrorString, ShouldEqual, "failed to parse query")
+			})
+
+			Convey("Should return the error when fail fast is enabled", func() {
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				rp.FailFast = true
+				result, err := rp.getTimeSeries()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "failed to parse query")
+				So(result, ShouldBeNil)
+			})
+		})
+
+		Convey("With formatted percentiles", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "3": {
+                "buckets": [
+                  {
+                    "1": { "values": { "75": 3.3, "75_as_string": "3.3ms", "90": 5.5, "90_as_string": "5.5ms" } },
+                    "doc_count": 10,
+                    "key": %s
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Time series should use numeric values", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "percentiles", "field": "@load_time", "settings": { "percents": ["75", "90"], "format": "0.0ms", "valuesAsString": true }, "id": "1" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "3" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, fmt.Sprintf(response, "1000"))
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 2)
+				So(queryRes.Series[0].Name, ShouldEqual, "p75 @load_time")
+				So(queryRes.Series[0].Points[0][0].Float64, ShouldEqual, 3.3)
+				So(queryRes.Series[1].Name, ShouldEqual, "p90 @load_time")
+				So(queryRes.Series[1].Points[0][0].Float64, ShouldEqual, 5.5)
+			})
+
+			Convey("Table should include formatted values", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "percentiles", "field": "@load_time", "settings": { "percents": ["75", "90"], "format": "0.0ms", "valuesAsString": true }, "id": "1" }],
+						"bucketAggs": [{ "type": "terms", "field": "host", "id": "3" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, fmt.Sprintf(response, `"server-1"`))
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Tables, ShouldHaveLength, 1)
+				cols := queryRes.Tables[0].Columns
+				So(cols, ShouldHaveLength, 5)
+				So(cols[1].Text, ShouldEqual, "p75")
+				So(cols[2].Text, ShouldEqual, "p75 formatted")
+				So(cols[3].Text, ShouldEqual, "p90")
+				So(cols[4].Text, ShouldEqual, "p90 formatted")
+
+				row := queryRes.Tables[0].Rows[0]
+				So(row[0].(string), ShouldEqual, "server-1")
+				So(row[1].(null.Float).Float64, ShouldEqual, 3.3)
+				So(row[2].(string), ShouldEqual, "3.3ms")
+				So(row[3].(null.Float).Float64, ShouldEqual, 5.5)
+				So(row[4].(string), ShouldEqual, "5.5ms")
+			})
+		})
+
+		Convey("Terms with include filter", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2", "settings": { "include": "server-.*" } },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+				"B": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "sum_other_doc_count": 42,
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] },
+                    "doc_count": 1,
+                    "key": "server-1"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			rp, err := newResponseParserForTest(map[string]string{"A": targets["A"]}, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 1)
+			So(queryRes.Meta, ShouldNotBeNil)
+			filter := queryRes.Meta.GetPath("termsFilters", "2")
+			So(filter.Get("include").MustString(), ShouldEqual, "server-.*")
+			_, hasExclude := filter.CheckGet("exclude")
+			So(hasExclude, ShouldBeFalse)
+			So(filter.Get("sumOtherDocCount").MustInt64(), ShouldEqual, 42)
+
+			rp, err = newResponseParserForTest(map[string]string{"B": targets["B"]}, response)
+			So(err, ShouldBeNil)
+			result, err = rp.getTimeSeries()
+			So(err, ShouldBeNil)
+			_, hasFilters := result.Results["B"].Meta.CheckGet("termsFilters")
+			So(hasFilters, ShouldBeFalse)
+		})
+
+		Convey("Wide table converted back to time series", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "doc_count": 10, "key": 1000 },
+                  { "doc_count": 15, "key": 2000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+			series := result.Results["A"].Series
+
+			seriesList, err := rp.wideTableToTimeSeries(rp.toWideTable(series, defaultTimeColumn))
+			So(err, ShouldBeNil)
+			So(seriesList, ShouldHaveLength, 1)
+			So(seriesList[0].Name, ShouldEqual, "Count")
+			So(seriesList[0].Points, ShouldResemble, series[0].Points)
+
+			Convey("Should map each value column to its own series", func() {
+				table := &tsdb.Table{
+					Columns: []tsdb.TableColumn{{Text: "Time"}, {Text: "Count"}, {Text: "Average"}},
+					Rows: []tsdb.RowValues{
+						{null.FloatFrom(1000), null.FloatFrom(10), null.FloatFrom(1.5)},
+						{null.FloatFrom(2000), null.FloatFrom(15), null.NewFloat(0, false)},
+					},
+				}
+				seriesList, err := rp.wideTableToTimeSeries(table)
+				So(err, ShouldBeNil)
+				So(seriesList, ShouldHaveLength, 2)
+				So(seriesList[1].Name, ShouldEqual, "Average")
+				So(seriesList[1].Points, ShouldHaveLength, 2)
+				So(seriesList[1].Points[0][0].Float64, ShouldEqual, 1.5)
+				So(seriesList[1].Points[1][0].Valid, ShouldBeFalse)
+				So(seriesList[1].Points[1][1].Float64, ShouldEqual, 2000)
+			})
+		})
+
+		Convey("Heatmap output", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"output": "heatmap",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "date_histogram", "field": "@timestamp", "id": "2" },
+						{ "type": "histogram", "field": "bytes", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 1, "key": 0 }, { "doc_count": 3, "key": 100 }] },
+                    "doc_count": 4,
+                    "key": 1000
+                  },
+                  {
+                    "3": { "buckets": [{ "doc_count": 2, "key": 100 }, { "doc_count": 5, "key": 200 }] },
+                    "doc_count": 7,
+                    "key": 2000
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 0)
+			So(queryRes.Tables, ShouldHaveLength, 1)
+
+			cols := queryRes.Tables[0].Columns
+			So(cols, ShouldHaveLength, 4)
+			So(cols[0].Text, ShouldEqual, "Time")
+			So(cols[1].Text, ShouldEqual, "0")
+			So(cols[2].Text, ShouldEqual, "100")
+			So(cols[3].Text, ShouldEqual, "200")
+
+			rows := queryRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 2)
+			So(rows[0][0].(null.Float).Float64, ShouldEqual, 1000)
+			So(rows[0][1].(null.Float).Float64, ShouldEqual, 1)
+			So(rows[0][2].(null.Float).Float64, ShouldEqual, 3)
+			So(rows[0][3].(null.Float).Float64, ShouldEqual, 0)
+			So(rows[1][0].(null.Float).Float64, ShouldEqual, 2000)
+			So(rows[1][1].(null.Float).Float64, ShouldEqual, 0)
+			So(rows[1][2].(null.Float).Float64, ShouldEqual, 2)
+			So(rows[1][3].(null.Float).Float64, ShouldEqual, 5)
+		})
+
+		Convey("Missing count buckets", func() {
+			query := `{
+				"timeField": "@timestamp",
+				"missingCountAs": "%s",
+				"metrics": [{ "type": "count", "id": "1" }],
+				"bucketAggs": [
+					{ "type": "terms", "field": "host", "id": "2" },
+					{ "type": "date_histogram", "field": "@timestamp", "id": "3", "settings": { "min_doc_count": 1 } }
+				]
+			}`
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 1, "key": 1000 }, { "doc_count": 0, "key": 2000 }, { "doc_count": 3, "key": 3000 }] },
+                    "doc_count": 4,
+                    "key": "server1"
+                  },
+                  {
+                    "3": { "buckets": [{ "doc_count": 2, "key": 1000 }] },
+                    "doc_count": 2,
+                    "key": "server2"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should fill missing buckets with null", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": fmt.Sprintf(query, "null")}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				seriesList := result.Results["A"].Series
+				So(seriesList, ShouldHaveLength, 2)
+				So(seriesList[0].Points, ShouldHaveLength, 3)
+				So(seriesList[0].Points[1][0].Valid, ShouldBeTrue)
+				So(seriesList[0].Points[1][0].Float64, ShouldEqual, 0)
+
+				So(seriesList[1].Name, ShouldEqual, "server2")
+				So(seriesList[1].Points, ShouldHaveLength, 3)
+				So(seriesList[1].Points[0][0].Float64, ShouldEqual, 2)
+				So(seriesList[1].Points[1][0].Valid, ShouldBeFalse)
+				So(seriesList[1].Points[1][1].Float64, ShouldEqual, 2000)
+				So(seriesList[1].Points[2][0].Valid, ShouldBeFalse)
+				So(seriesList[1].Points[2][1].Float64, ShouldEqual, 3000)
+			})
+
+			Convey("Should fill missing buckets with zero", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": fmt.Sprintf(query, "zero")}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				seriesList := result.Results["A"].Series
+				So(seriesList, ShouldHaveLength, 2)
+				So(seriesList[1].Points, ShouldHaveLength, 3)
+				So(seriesList[1].Points[1][0].Valid, ShouldBeTrue)
+				So(seriesList[1].Points[1][0].Float64, ShouldEqual, 0)
+				So(seriesList[1].Points[2][0].Valid, ShouldBeTrue)
+				So(seriesList[1].Points[2][0].Float64, ShouldEqual, 0)
+			})
+
+			Convey("Should not fill missing buckets by default", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": fmt.Sprintf(query, "")}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				seriesList := result.Results["A"].Series
+				So(seriesList, ShouldHaveLength, 2)
+				So(seriesList[1].Points, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("Rare terms response", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "rare_terms", "field": "host", "id": "2", "settings": { "max_doc_count": 2 } }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "key": "server-9", "doc_count": 2 },
+                  { "key": "server-1", "doc_count": 1 },
+                  { "key": "server-5", "doc_count": 1 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Tables, ShouldHaveLength, 1)
+			rows := queryRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 3)
+			So(rows[0][0].(string), ShouldEqual, "server-9")
+			So(rows[0][1].(null.Float).Float64, ShouldEqual, 2)
+			So(rows[1][0].(string), ShouldEqual, "server-1")
+			So(rows[2][0].(string), ShouldEqual, "server-5")
+
+			So(queryRes.Meta.GetPath("rareTermsMaxDocCount", "2").MustInt64(), ShouldEqual, 2)
+		})
+
+		Convey("Date histogram with out of order buckets", func() {
+			query := `{
+				"timeField": "@timestamp",
+				"metrics": [{ "type": "count", "id": "1" }],
+				"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2"%s }]
+			}`
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "doc_count": 3, "key": 3000 },
+                  { "doc_count": 1, "key": 1000 },
+                  { "doc_count": 2, "key": 2000 },
+                  { "doc_count": 4, "key": 1000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should sort points by time keeping duplicates in order", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": fmt.Sprintf(query, "")}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				points := result.Results["A"].Series[0].Points
+				So(points, ShouldHaveLength, 4)
+				So(points[0][1].Float64, ShouldEqual, 1000)
+				So(points[0][0].Float64, ShouldEqual, 1)
+				So(points[1][1].Float64, ShouldEqual, 1000)
+				So(points[1][0].Float64, ShouldEqual, 4)
+				So(points[2][1].Float64, ShouldEqual, 2000)
+				So(points[3][1].Float64, ShouldEqual, 3000)
+			})
+
+			Convey("Should sum duplicate timestamps when configured", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": fmt.Sprintf(query, `, "settings": { "duplicateTimestamps": "sum" }`)}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				points := result.Results["A"].Series[0].Points
+				So(points, ShouldHaveLength, 3)
+				So(points[0][1].Float64, ShouldEqual, 1000)
+				So(points[0][0].Float64, ShouldEqual, 5)
+				So(points[1][1].Float64, ShouldEqual, 2000)
+				So(points[2][1].Float64, ShouldEqual, 3000)
+			})
+		})
+
+		Convey("Filters agg with filter query alias", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"alias": "{{filter}} ({{filterQuery}})",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{
+							"type": "filters",
+							"id": "2",
+							"settings": {
+								"filters": [{ "query": "@metric:cpu", "label": "CPU" }, { "query": "@metric:logins.count" }]
+							}
+						},
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+
+			Convey("Should expose the query of named filters", func() {
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": {
+                    "CPU": { "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] } },
+                    "@metric:logins.count": { "3": { "buckets": [{ "doc_count": 2, "key": 1000 }] } }
+                  }
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 2)
+				So(queryRes.Series[0].Name, ShouldEqual, "@metric:logins.count (@metric:logins.count)")
+				So(queryRes.Series[1].Name, ShouldEqual, "CPU (@metric:cpu)")
+				So(queryRes.Series[1].Tags, ShouldResemble, map[string]string{"filter": "CPU"})
+			})
+
+			Convey("Should expose the query of anonymous filters by index", func() {
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] } },
+                    { "3": { "buckets": [{ "doc_count": 2, "key": 1000 }] } }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 2)
+				So(queryRes.Series[0].Name, ShouldEqual, "CPU (@metric:cpu)")
+				So(queryRes.Series[1].Name, ShouldEqual, "@metric:logins.count (@metric:logins.count)")
+				So(queryRes.Series[0].Tags, ShouldResemble, map[string]string{"filter": "CPU"})
+			})
+
+			Convey("Should not add a filter query table column", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "filters", "id": "2", "settings": { "filters": [{ "query": "@metric:cpu", "label": "CPU" }] } },
+							{ "type": "terms", "field": "host", "id": "3" }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": {
+                    "CPU": { "3": { "buckets": [{ "doc_count": 1, "key": "server1" }] } }
+                  }
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldResemble, []tsdb.TableColumn{{Text: "filter"}, {Text: "host"}, {Text: "Count"}})
+				So(table.Rows, ShouldResemble, []tsdb.RowValues{{"CPU", "server1", null.FloatFrom(1)}})
+			})
+		})
+
+		Convey("With profile enabled", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"profile": true,
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": { "buckets": [{ "doc_count": 10, "key": 1000 }] }
+            },
+            "profile": {
+              "shards": [
+                {
+                  "id": "[node1][index][0]",
+                  "searches": [
+                    {
+                      "query": [
+                        { "type": "BooleanQuery", "description": "+a +b", "time_in_nanos": 100 },
+                        { "type": "TermQuery", "description": "host:a", "time_in_nanos": 500 }
+                      ]
+                    }
+                  ],
+                  "aggregations": [{ "type": "DateHistogramAggregator", "time_in_nanos": 50 }]
+                },
+                {
+                  "id": "[node2][index][1]",
+                  "searches": [
+                    {
+                      "query": [
+                        { "type": "BooleanQuery", "description": "+a +b", "time_in_nanos": 1000 },
+                        { "type": "TermQuery", "description": "host:b", "time_in_nanos": 10 },
+                        { "type": "MatchAllDocsQuery", "description": "*:*", "time_in_nanos": 5 }
+                      ]
+                    }
+                  ]
+                }
+              ]
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 1)
+			So(queryRes.Meta, ShouldNotBeNil)
+
+			profile := queryRes.Meta.Get("profile")
+			So(profile.Get("shardCount").MustInt(), ShouldEqual, 2)
+			So(profile.Get("totalTimeNanos").MustInt64(), ShouldEqual, 1665)
+
+			shards := profile.Get("slowestShards").Interface().([]profileEntry)
+			So(shards, ShouldHaveLength, 2)
+			So(shards[0].Name, ShouldEqual, "[node2][index][1]")
+			So(shards[0].TimeInNanos, ShouldEqual, 1015)
+			So(shards[1].TimeInNanos, ShouldEqual, 650)
+
+			queries := profile.Get("slowestQueries").Interface().([]profileEntry)
+			So(queries, ShouldHaveLength, 3)
+			So(queries[0].Name, ShouldEqual, "BooleanQuery +a +b")
+			So(queries[0].TimeInNanos, ShouldEqual, 1000)
+			So(queries[1].TimeInNanos, ShouldEqual, 500)
+			So(queries[2].TimeInNanos, ShouldEqual, 100)
+		})
+
+		Convey("Multiple cardinality metrics", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [
+						{ "type": "cardinality", "field": "user", "id": "1", "settings": { "precision_threshold": 100 } },
+						{ "type": "cardinality", "field": "user", "id": "3", "settings": { "precision_threshold": 3000 } },
+						{ "type": "cardinality", "field": "session", "id": "4" }
+					],
+					"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "1": { "value": 98 },
+                    "3": { "value": 100 },
+                    "4": { "value": 12 },
+                    "key": "server-1",
+                    "doc_count": 369
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Tables, ShouldHaveLength, 1)
+			cols := queryRes.Tables[0].Columns
+			So(cols, ShouldHaveLength, 4)
+			So(cols[1].Text, ShouldEqual, "Unique Count user (precision 100)")
+			So(cols[2].Text, ShouldEqual, "Unique Count user (precision 3000)")
+			So(cols[3].Text, ShouldEqual, "Unique Count session")
+
+			row := queryRes.Tables[0].Rows[0]
+			So(row[1].(null.Float).Float64, ShouldEqual, 98)
+			So(row[2].(null.Float).Float64, ShouldEqual, 100)
+			So(row[3].(null.Float).Float64, ShouldEqual, 12)
+		})
+
+		Convey("Multiple responses for the same target", func() {
+			query, err := simplejson.NewJson([]byte(`{
+				"timeField": "@timestamp",
+				"metrics": [{ "type": "count", "id": "1" }],
+				"bucketAggs": [
+					{ "type": "terms", "field": "host", "id": "2" },
+					{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+				]
+			}`))
+			So(err, ShouldBeNil)
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 1, "key": 1000 }, { "doc_count": 3, "key": 2000 }] },
+                    "doc_count": 4,
+                    "key": "server1"
+                  }
+                ]
+              }
+            }
+          },
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 2, "key": 2000 }, { "doc_count": 5, "key": 3000 }] },
+                    "doc_count": 7,
+                    "key": "server1"
+                  },
+                  {
+                    "3": { "buckets": [{ "doc_count": 6, "key": 1000 }] },
+                    "doc_count": 6,
+                    "key": "server2"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForQueriesForTest([]*tsdb.Query{{Model: query, RefId: "A"}, {Model: query, RefId: "A"}}, response)
+			So(err, ShouldBeNil)
+			So(rp.Targets, ShouldHaveLength, 2)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+			So(result.Results, ShouldHaveLength, 1)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+
+			seriesOne := queryRes.Series[0]
+			So(seriesOne.Name, ShouldEqual, "server1")
+			So(seriesOne.Points, ShouldHaveLength, 3)
+			So(seriesOne.Points[0][0].Float64, ShouldEqual, 1)
+			So(seriesOne.Points[1][0].Float64, ShouldEqual, 5)
+			So(seriesOne.Points[1][1].Float64, ShouldEqual, 2000)
+			So(seriesOne.Points[2][0].Float64, ShouldEqual, 5)
+			So(seriesOne.Points[2][1].Float64, ShouldEqual, 3000)
+
+			seriesTwo := queryRes.Series[1]
+			So(seriesTwo.Name, ShouldEqual, "server2")
+			So(seriesTwo.Points, ShouldHaveLength, 1)
+			So(seriesTwo.Points[0][0].Float64, ShouldEqual, 6)
+
+			firstBuckets := simplejson.NewFromAny(rp.Responses[0].Aggregations).GetPath("2", "buckets").MustArray()
+			So(firstBuckets, ShouldHaveLength, 1)
+		})
+
+		Convey("Multiple responses for the same target with metric values", func() {
+			query, err := simplejson.NewJson([]byte(`{
+				"timeField": "@timestamp",
+				"metrics": [
+					{ "type": "sum", "field": "bytes", "id": "1" },
+					{ "type": "max", "field": "bytes", "id": "2" },
+					{ "type": "avg", "field": "bytes", "id": "4" }
+				],
+				"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "3" }]
+			}`))
+			So(err, ShouldBeNil)
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "3": {
+                "buckets": [
+                  { "1": { "value": 10 }, "2": { "value": 3 }, "4": { "value": 2 }, "doc_count": 4, "key": 1000 },
+                  { "1": { "value": 5 }, "2": { "value": 8 }, "4": { "value": 1 }, "doc_count": 5, "key": 2000 }
+                ]
+              }
+            }
+          },
+          {
+            "aggregations": {
+              "3": {
+                "buckets": [
+                  { "1": { "value": 7 }, "2": { "value": 4 }, "4": { "value": 9 }, "doc_count": 1, "key": 2000 },
+                  { "1": { "value": 1 }, "2": { "value": 1 }, "4": { "value": 1 }, "doc_count": 1, "key": 3000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForQueriesForTest([]*tsdb.Query{{Model: query, RefId: "A"}, {Model: query, RefId: "A"}}, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 3)
+
+			sum := queryRes.Series[0]
+			So(sum.Name, ShouldEqual, "Sum bytes")
+			So(sum.Points, ShouldHaveLength, 3)
+			So(sum.Points[0][0].Float64, ShouldEqual, 10)
+			So(sum.Points[1][0].Float64, ShouldEqual, 12)
+			So(sum.Points[2][0].Float64, ShouldEqual, 1)
+
+			max := queryRes.Series[1]
+			So(max.Name, ShouldEqual, "Max bytes")
+			So(max.Points[0][0].Float64, ShouldEqual, 3)
+			So(max.Points[1][0].Float64, ShouldEqual, 8)
+			So(max.Points[2][0].Float64, ShouldEqual, 1)
+
+			avg := queryRes.Series[2]
+			So(avg.Name, ShouldEqual, "Average bytes")
+			So(avg.Points[0][0].Float64, ShouldEqual, 2)
+			So(avg.Points[1][0].Valid, ShouldBeFalse)
+			So(avg.Points[2][0].Float64, ShouldEqual, 1)
+
+			So(queryRes.Meta.Get("notices").MustArray(), ShouldResemble, []interface{}{"some metrics can't be combined across searches and were left empty"})
+		})
+
+		Convey("Series with only null values", func() {
+			query := `{
+				"timeField": "@timestamp",
+				"dropAllNullSeries": %t,
+				"metrics": [{ "type": "avg", "field": "a", "id": "1" }, { "type": "avg", "field": "b", "id": "2" }],
+				"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "3" }]
+			}`
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "3": {
+                "buckets": [
+                  { "1": { "value": null }, "2": { "value": null }, "doc_count": 10, "key": 1000 },
+                  { "1": { "value": null }, "2": { "value": 5 }, "doc_count": 15, "key": 2000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should keep all null series by default", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": fmt.Sprintf(query, false)}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].Series, ShouldHaveLength, 2)
+			})
+
+			Convey("Should drop all null series when enabled", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": fmt.Sprintf(query, true)}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				seriesList := result.Results["A"].Series
+				So(seriesList, ShouldHaveLength, 1)
+				So(seriesList[0].Name, ShouldEqual, "Average b")
+				So(seriesList[0].Points, ShouldHaveLength, 2)
+			})
+		})
+
+		Convey("Deeply nested bucket aggregations", func() {
+			newNestedQuery := func(depth int) (string, string) {
+				bucketAggs := make([]interface{}, 0)
+				var aggs map[string]interface{}
+				for i := depth; i > 0; i-- {
+					id := strconv.Itoa(i + 1)
+					bucketAggs = append([]interface{}{map[string]interface{}{"type": "terms", "field": "f" + id, "id": id}}, bucketAggs...)
+					bucket := map[string]interface{}{"key": "k" + id, "doc_count": 1}
+					for k, v := range aggs {
+						bucket[k] = v
+					}
+					aggs = map[string]interface{}{id: map[string]interface{}{"buckets": []interface{}{bucket}}}
+				}
+				query, _ := json.Marshal(map[string]interface{}{
+					"timeField":  "@timestamp",
+					"metrics":    []interface{}{map[string]interface{}{"type": "count", "id": "1"}},
+					"bucketAggs": bucketAggs,
+				})
+				response, _ := json.Marshal(map[string]interface{}{
+					"responses": []interface{}{map[string]interface{}{"aggregations": aggs}},
+				})
+				return string(query), string(response)
+			}
+
+			Convey("Should parse aggregations up to the maximum depth", func() {
+				query, response := newNestedQuery(10)
+				rp, err := newResponseParserForTest(map[string]string{"A": query}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].Tables, ShouldHaveLength, 1)
+				So(result.Results["A"].Tables[0].Rows, ShouldHaveLength, 1)
+			})
+
+			Convey("Should fail the target when exceeding the maximum depth", func() {
+				query, response := newNestedQuery(11)
+				rp, err := newResponseParserForTest(map[string]string{"A": query}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].ErrorString, ShouldContainSubstring, "maximum depth of 10")
+			})
+		})
+
+		Convey("Numeric group by keys in tables", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "histogram", "field": "bytes", "id": "2" },
+						{ "type": "terms", "field": "host", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 1, "key": "server-1" }] },
+                    "doc_count": 1,
+                    "key": 1000
+                  },
+                  {
+                    "3": { "buckets": [{ "doc_count": 2, "key": "server-2" }] },
+                    "doc_count": 2,
+                    "key": 2000,
+                    "key_as_string": "2 kB"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Tables, ShouldHaveLength, 1)
+			rows := queryRes.Tables[0].Rows
+			So(rows, ShouldHaveLength, 2)
+			So(rows[0][0].(null.Float).Float64, ShouldEqual, 1000)
+			So(rows[0][1].(string), ShouldEqual, "server-1")
+			So(rows[1][0].(string), ShouldEqual, "2 kB")
+			So(rows[1][1].(string), ShouldEqual, "server-2")
+		})
+
+		Convey("With extended stats population and sampling std deviation", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "extended_stats", "meta": { "std_deviation_population": true, "std_deviation_sampling": true }, "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "1": { "std_deviation": 2, "std_deviation_population": 2, "std_deviation_sampling": 2.5 },
+                    "doc_count": 10,
+                    "key": 1000
+                  },
+                  {
+                    "1": { "std_deviation": 3 },
+                    "doc_count": 10,
+                    "key": 2000
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+
+			seriesOne := queryRes.Series[0]
+			So(seriesOne.Name, ShouldEqual, "Std Dev Population")
+			So(seriesOne.Points, ShouldHaveLength, 2)
+			So(seriesOne.Points[0][0].Float64, ShouldEqual, 2)
+			So(seriesOne.Points[1][0].Valid, ShouldBeFalse)
+
+			seriesTwo := queryRes.Series[1]
+			So(seriesTwo.Name, ShouldEqual, "Std Dev Sampling")
+			So(seriesTwo.Points[0][0].Float64, ShouldEqual, 2.5)
+			So(seriesTwo.Points[1][0].Valid, ShouldBeFalse)
+		})
+
+		Convey("Aliased count metric next to a default count", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [
+						{ "type": "count", "id": "1", "settings": { "alias": "Documents" } },
+						{ "type": "count", "id": "3" }
+					],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "doc_count": 10, "key": 1000 },
+                  { "doc_count": 15, "key": 2000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+			So(queryRes.Series[0].Name, ShouldEqual, "Documents")
+			So(queryRes.Series[0].Points[0][0].Float64, ShouldEqual, 10)
+			So(queryRes.Series[1].Name, ShouldEqual, "Count")
+			So(queryRes.Series[1].Points[0][0].Float64, ShouldEqual, 10)
+		})
+
+		Convey("Two default count metrics grouped by terms", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }, { "type": "count", "id": "4" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": {
+                      "buckets": [{ "doc_count": 1, "key": 1000 }]
+                    },
+                    "doc_count": 1,
+                    "key": "server1"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+			So(queryRes.Series[0].Name, ShouldEqual, "server1 Count 1")
+			So(queryRes.Series[1].Name, ShouldEqual, "server1 Count 4")
+
+			Convey("Should not return the metric id tag with an alias", func() {
+				rp.Targets[0].Alias = "{{term host}}"
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 2)
+				So(series[0].Name, ShouldEqual, "server1")
+				So(series[0].Tags, ShouldResemble, map[string]string{"host": "server1"})
+			})
+		})
+
+		Convey("Aliased count metric in a table", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [
+						{ "type": "count", "id": "1" },
+						{ "type": "count", "id": "3", "settings": { "alias": "Documents" } }
+					],
+					"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [{ "doc_count": 5, "key": "server1" }]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			table := result.Results["A"].Tables[0]
+			So(table.Columns, ShouldHaveLength, 3)
+			So(table.Columns[0].Text, ShouldEqual, "host")
+			So(table.Columns[1].Text, ShouldEqual, "Count")
+			So(table.Columns[2].Text, ShouldEqual, "Documents")
+			So(table.Rows[0][1].(null.Float).Float64, ShouldEqual, 5)
+			So(table.Rows[0][2].(null.Float).Float64, ShouldEqual, 5)
+		})
+
+		Convey("Boxplot with whiskers", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "boxplot", "field": "load", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "1": { "min": 1, "max": 9, "q1": 2, "q2": 5, "q3": 8, "lower": 1, "upper": 9 },
+                    "doc_count": 3,
+                    "key": 1000
+                  },
+                  {
+                    "1": { "min": 0, "max": 100, "q1": 10, "q2": 20, "q3": 30, "lower": 0, "upper": 60 },
+                    "doc_count": 50,
+                    "key": 2000
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 7)
+
+			names := make([]string, 0)
+			for _, series := range queryRes.Series {
+				names = append(names, series.Name)
+			}
+			So(names, ShouldResemble, []string{
+				"Min load", "Lower Whisker load", "Q1 load", "Median load", "Q3 load", "Upper Whisker load", "Max load",
+			})
+
+			So(queryRes.Series[0].Points[0][0].Float64, ShouldEqual, 1)
+			So(queryRes.Series[1].Points[0][0].Float64, ShouldEqual, 1)
+			So(queryRes.Series[5].Points[0][0].Float64, ShouldEqual, 9)
+			So(queryRes.Series[5].Points[1][0].Float64, ShouldEqual, 60)
+			So(queryRes.Series[6].Points[1][0].Float64, ShouldEqual, 100)
+		})
+
+		Convey("Boxplot without whiskers in a table", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "boxplot", "field": "load", "id": "1" }],
+					"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "1": { "min": 1, "max": 9, "q1": 2, "q2": 5, "q3": 8 },
+                    "doc_count": 3,
+                    "key": "server1"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			table := result.Results["A"].Tables[0]
+			So(table.Columns, ShouldHaveLength, 6)
+			So(table.Columns[1].Text, ShouldEqual, "Min")
+			So(table.Columns[2].Text, ShouldEqual, "Q1")
+			So(table.Columns[3].Text, ShouldEqual, "Median")
+			So(table.Columns[4].Text, ShouldEqual, "Q3")
+			So(table.Columns[5].Text, ShouldEqual, "Max")
+			So(table.Rows[0][3].(null.Float).Float64, ShouldEqual, 5)
+		})
+
+		Convey("Metric value types in tables", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [
+						{ "type": "max", "field": "version", "id": "1", "settings": { "valueType": "string" } },
+						{ "type": "min", "field": "version", "id": "3", "settings": { "valueType": "number" } }
+					],
+					"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "1": { "value": "0012" }, "3": { "value": "0012" }, "doc_count": 1, "key": "server1" },
+                  { "1": { "value": 7 }, "3": { "value": 7 }, "doc_count": 1, "key": "server2" },
+                  { "1": { "value": "v1" }, "3": { "value": "v1" }, "doc_count": 1, "key": "server3" },
+                  { "1": { "value": null }, "3": { "value": null }, "doc_count": 1, "key": "server4" },
+                  { "1": { "value": 1234567 }, "3": { "value": 1234567 }, "doc_count": 1, "key": "server5" },
+                  { "1": { "value": 0.25 }, "3": { "value": 0.25 }, "doc_count": 1, "key": "server6" }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			table := result.Results["A"].Tables[0]
+			So(table.Columns, ShouldHaveLength, 3)
+			So(table.Rows, ShouldHaveLength, 6)
+
+			So(table.Rows[0][1], ShouldEqual, "0012")
+			So(table.Rows[1][1], ShouldEqual, "7")
+			So(table.Rows[2][1], ShouldEqual, "v1")
+			So(table.Rows[3][1], ShouldBeNil)
+			So(table.Rows[4][1], ShouldEqual, "1234567")
+			So(table.Rows[5][1], ShouldEqual, "0.25")
+
+			So(table.Rows[0][2].(null.Float).Float64, ShouldEqual, 12)
+			So(table.Rows[1][2].(null.Float).Float64, ShouldEqual, 7)
+			So(table.Rows[2][2].(null.Float).Valid, ShouldBeFalse)
+			So(table.Rows[3][2].(null.Float).Valid, ShouldBeFalse)
+			So(table.Rows[4][2].(null.Float).Float64, ShouldEqual, 1234567)
+			So(table.Rows[5][2].(null.Float).Float64, ShouldEqual, 0.25)
+		})
+
+		Convey("Series count estimate", func() {
+			shapes := []struct {
+				target   string
+				response string
+			}{
+				{
+					target: `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }, { "type": "avg", "field": "value", "id": "4" }, { "type": "sum", "field": "value", "id": "5", "hide": true }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+					response: `{
+						"responses": [{
+							"aggregations": {
+								"2": {
+									"buckets": [
+										{ "3": { "buckets": [{ "4": { "value": 1 }, "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": "server1" },
+										{ "3": { "buckets": [{ "4": { "value": 2 }, "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": "server2" }
+									]
+								}
+							}
+						}]
+					}`,
+				},
+				{
+					target: `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "percentiles", "field": "value", "settings": { "percents": ["50", "90"] }, "id": "1" }],
+						"bucketAggs": [
+							{ "type": "filters", "id": "2", "settings": { "filters": [{ "query": "@metric:cpu" }, { "query": "@metric:logins.count" }] } },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+					response: `{
+						"responses": [{
+							"aggregations": {
+								"2": {
+									"buckets": {
+										"@metric:cpu": { "3": { "buckets": [{ "1": { "values": { "50": 1, "90": 2 } }, "doc_count": 1, "key": 1000 }] }, "doc_count": 1 },
+										"@metric:logins.count": { "3": { "buckets": [{ "1": { "values": { "50": 3, "90": 4 } }, "doc_count": 1, "key": 1000 }] }, "doc_count": 1 }
+									}
+								}
+							}
+						}]
+					}`,
+				},
+				{
+					target: `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "extended_stats", "field": "value", "meta": { "max": true, "min": true, "avg": false }, "id": "1" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "3" }]
+					}`,
+					response: `{
+						"responses": [{
+							"aggregations": {
+								"3": { "buckets": [{ "1": { "max": 2, "min": 1 }, "doc_count": 1, "key": 1000 }] }
+							}
+						}]
+					}`,
+				},
+				{
+					target: `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "percentiles", "field": "value", "settings": { "percents": ["50", "90"] }, "id": "1" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "3" }]
+					}`,
+					response: `{
+						"responses": [{
+							"aggregations": {
+								"3": {
+									"buckets": {
+										"1000": { "1": { "values": { "50": 1, "90": 2 } }, "doc_count": 1, "key": 1000 }
+									}
+								}
+							}
+						}]
+					}`,
+				},
+			}
+
+			for _, shape := range shapes {
+				rp, err := newResponseParserForTest(map[string]string{"A": shape.target}, shape.response)
+				So(err, ShouldBeNil)
+				estimate := rp.estimateSeriesCount(rp.Targets[0], rp.Responses[0])
+
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(estimate, ShouldEqual, len(result.Results["A"].Series))
+				So(estimate, ShouldBeGreaterThan, 0)
+			}
+
+			rp, err := newResponseParserForTest(map[string]string{"A": `{
+				"timeField": "@timestamp",
+				"metrics": [{ "type": "count", "id": "1" }],
+				"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+			}`}, `{
+				"responses": [{
+					"aggregations": {
+						"2": { "buckets": [{ "doc_count": 1, "key": "server1" }, { "doc_count": 2, "key": "server2" }] }
+					}
+				}]
+			}`)
+			So(err, ShouldBeNil)
+			So(rp.estimateSeriesCount(rp.Targets[0], rp.Responses[0]), ShouldEqual, 2)
+		})
+
+		Convey("Series limit", func() {
+			query := `{
+				"timeField": "@timestamp",
+				"maxSeries": %d,
+				"metrics": [{ "type": "count", "id": "1" }],
+				"bucketAggs": [
+					{ "type": "terms", "field": "host", "id": "2" },
+					{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+				]
+			}`
+			targets := map[string]string{
+				"A": fmt.Sprintf(query, 1),
+				"B": fmt.Sprintf(query, 2),
+			}
+			hosts := `{
+				"aggregations": {
+					"2": {
+						"buckets": [
+							{ "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": "server1" },
+							{ "3": { "buckets": [{ "doc_count": 2, "key": 1000 }] }, "doc_count": 2, "key": "server2" }
+						]
+					}
+				}
+			}`
+			rp, err := newResponseParserForTest(targets, fmt.Sprintf(`{ "responses": [%s, %s] }`, hosts, hosts))
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			So(result.Results["A"].ErrorString, ShouldEqual, "the response has about 2 series, more than the limit of 1")
+			So(result.Results["A"].Series, ShouldBeEmpty)
+			So(result.Results["B"].ErrorString, ShouldBeEmpty)
+			So(result.Results["B"].Series, ShouldHaveLength, 2)
+		})
+
+		Convey("Scripted basic metrics", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [
+						{ "type": "avg", "id": "1", "settings": { "script": { "inline": "_value * 2" } } },
+						{ "type": "avg", "id": "3", "settings": { "script": "_value * 3", "label": "tripled" } },
+						{ "type": "sum", "id": "4" }
+					],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "1": { "value": 2 }, "3": { "value": 3 }, "4": { "value": 4 }, "doc_count": 1, "key": 1000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 3)
+			So(queryRes.Series[0].Name, ShouldEqual, "Average _value * 2")
+			So(queryRes.Series[1].Name, ShouldEqual, "Average tripled")
+			So(queryRes.Series[2].Name, ShouldEqual, "Sum")
+		})
+
+		Convey("Scripted basic metrics in a table", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [
+						{ "type": "max", "id": "1", "settings": { "script": { "inline": "doc['a'].value" } } },
+						{ "type": "max", "id": "3" }
+					],
+					"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [{ "1": { "value": 1 }, "3": { "value": 2 }, "doc_count": 1, "key": "server1" }]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			table := result.Results["A"].Tables[0]
+			So(table.Columns, ShouldHaveLength, 3)
+			So(table.Columns[1].Text, ShouldEqual, "Max doc['a'].value")
+			So(table.Columns[2].Text, ShouldEqual, "Max")
+		})
+
+		Convey("Wide output with a custom time column", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"output": "wide",
+					"timeColumn": "timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "doc_count": 10, "key": 1000 },
+                  { "doc_count": 15, "key": 2000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 0)
+			So(queryRes.Tables, ShouldHaveLength, 1)
+			table := queryRes.Tables[0]
+			So(table.Columns[0].Text, ShouldEqual, "timestamp")
+			So(table.Columns[1].Text, ShouldEqual, "Count")
+
+			seriesList, err := rp.wideTableToTimeSeries(table)
+			So(err, ShouldBeNil)
+			So(seriesList, ShouldHaveLength, 1)
+			So(seriesList[0].Name, ShouldEqual, "Count")
+			So(seriesList[0].Points[1][0].Float64, ShouldEqual, 15)
+			So(seriesList[0].Points[1][1].Float64, ShouldEqual, 2000)
+		})
+
+		Convey("T-test metric", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{
+						"type": "t_test",
+						"id": "1",
+						"settings": { "a": { "field": "startup_time_before" }, "b": { "field": "startup_time_after" }, "type": "paired" }
+					}],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "1": { "value": 0.1914368843365979 }, "doc_count": 10, "key": 1000 },
+                  { "1": { "value": null }, "doc_count": 1, "key": 2000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 1)
+			series := queryRes.Series[0]
+			So(series.Name, ShouldEqual, "T-Test")
+			So(series.Points, ShouldHaveLength, 2)
+			So(series.Points[0][0].Float64, ShouldEqual, 0.1914368843365979)
+			So(series.Points[1][0].Valid, ShouldBeFalse)
+			So(series.Points[1][1].Float64, ShouldEqual, 2000)
+		})
+
+		Convey("Strict term accuracy", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "doc_count_error_upper_bound": 3,
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] },
+                    "doc_count": 1,
+                    "key": "server1"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			target := func(settings string) map[string]string {
+				return map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						` + settings + `
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+			}
+
+			Convey("Should fail on any error with the default threshold", func() {
+				rp, err := newResponseParserForTest(target(`"strictTermAccuracy": true,`), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].ErrorString, ShouldContainSubstring, "host")
+				So(result.Results["A"].Series, ShouldBeEmpty)
+			})
+
+			Convey("Should fail above the threshold", func() {
+				rp, err := newResponseParserForTest(target(`"strictTermAccuracy": true, "maxDocCountError": 2,`), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].ErrorString, ShouldNotBeEmpty)
+			})
+
+			Convey("Should only fail the strict target", func() {
+				targets := target(`"strictTermAccuracy": true,`)
+				targets["B"] = target("")["A"]
+				hosts := `{
+					"aggregations": {
+						"2": {
+							"doc_count_error_upper_bound": 3,
+							"buckets": [{ "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": "server1" }]
+						}
+					}
+				}`
+				rp, err := newResponseParserForTest(targets, fmt.Sprintf(`{ "responses": [%s, %s] }`, hosts, hosts))
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].ErrorString, ShouldContainSubstring, "host")
+				So(result.Results["B"].ErrorString, ShouldBeEmpty)
+				So(result.Results["B"].Series, ShouldHaveLength, 1)
+			})
+
+			Convey("Should return the error when fail fast is enabled", func() {
+				rp, err := newResponseParserForTest(target(`"strictTermAccuracy": true,`), response)
+				So(err, ShouldBeNil)
+				rp.FailFast = true
+				_, err = rp.getTimeSeries()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "host")
+			})
+
+			Convey("Should not fail within the threshold", func() {
+				rp, err := newResponseParserForTest(target(`"strictTermAccuracy": true, "maxDocCountError": 3,`), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].Series, ShouldHaveLength, 1)
+			})
+
+			Convey("Should not fail when disabled", func() {
+				rp, err := newResponseParserForTest(target(""), response)
+				So(err, ShouldBeNil)
+				_, err = rp.getTimeSeries()
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("Alias with default values", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"alias": "{{host:none}} {{env:unknown}} {{field:all}} {{metric}} {{other}}",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] },
+                    "doc_count": 1,
+                    "key": "db:5432"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 1)
+			So(queryRes.Series[0].Name, ShouldEqual, "db:5432 unknown all Count {{other}}")
+		})
+
+		Convey("Percentiles method in meta", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [
+						{ "type": "percentiles", "field": "load", "settings": { "percents": ["50"], "hdr": { "number_of_significant_value_digits": 3 } }, "id": "1" },
+						{ "type": "percentiles", "field": "latency", "settings": { "percents": ["99"] }, "id": "3" }
+					],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "1": { "values": { "50.0": 1 } }, "3": { "values": { "99.0": 2 } }, "doc_count": 1, "key": 1000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+			So(queryRes.Meta.GetPath("percentilesMethod", "1").MustString(), ShouldEqual, "hdr")
+			So(queryRes.Meta.GetPath("percentilesMethod", "3").MustString(), ShouldEqual, "tdigest")
+		})
+
+		Convey("Split by index", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"splitByIndex": true,
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "index": {
+                "buckets": [
+                  {
+                    "2": { "buckets": [{ "doc_count": 1, "key": 1000 }] },
+                    "doc_count": 1,
+                    "key": "logs-2018.05.14"
+                  },
+                  {
+                    "2": { "buckets": [{ "doc_count": 2, "key": 1000 }] },
+                    "doc_count": 2,
+                    "key": "logs-2018.05.15"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+			So(queryRes.Series[0].Name, ShouldEqual, "logs-2018.05.14")
+			So(queryRes.Series[0].Tags["_index"], ShouldEqual, "logs-2018.05.14")
+			So(queryRes.Series[1].Name, ShouldEqual, "logs-2018.05.15")
+			So(queryRes.Series[1].Points[0][0].Float64, ShouldEqual, 2)
+		})
+
+		Convey("Aligned timestamps", func() {
+			target := func(interval, timeZone string) map[string]string {
+				return map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"alignInterval": "` + interval + `",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{
+								"type": "date_histogram",
+								"field": "@timestamp",
+								"id": "2",
+								"settings": { "interval": "1d", "time_zone": "` + timeZone + `" }
+							}
+						]
+					}`,
+				}
+			}
+
+			Convey("Should truncate calendar buckets shifted by daylight saving time", func() {
+				// daily buckets in Europe/Berlin, which switches to summer time on
+				// 2018-03-25: the 26 Mar bucket is returned an hour late, at 01:00
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "doc_count": 1, "key": 1521932400000 },
+                    { "doc_count": 2, "key": 1522018800000 },
+                    { "doc_count": 3, "key": 1522101600000 }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(target("1d", "Europe/Berlin"), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				points := result.Results["A"].Series[0].Points
+				So(points, ShouldHaveLength, 3)
+				// 25 Mar 00:00 CET is already on local midnight
+				So(points[0][1].Float64, ShouldEqual, 1521932400000)
+				// 26 Mar 01:00 CEST is moved back to 26 Mar 00:00 CEST
+				So(points[1][1].Float64, ShouldEqual, 1522015200000)
+				// 27 Mar 00:00 CEST is already on local midnight
+				So(points[2][1].Float64, ShouldEqual, 1522101600000)
+				So(points[1][0].Float64, ShouldEqual, 2)
+			})
+
+			Convey("Should truncate in a fixed offset time zone", func() {
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [{ "doc_count": 1, "key": 1521936000000 }]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(target("1d", "+01:00"), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				// 25 Mar 01:00 +01:00 is moved back to 25 Mar 00:00 +01:00
+				points := result.Results["A"].Series[0].Points
+				So(points[0][1].Float64, ShouldEqual, 1521932400000)
+			})
+
+			Convey("Should truncate weeks to Monday", func() {
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "doc_count": 1, "key": 1578268800000 },
+                    { "doc_count": 2, "key": 1578960000000 }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(target("1w", ""), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				points := result.Results["A"].Series[0].Points
+				So(points, ShouldHaveLength, 2)
+				// Monday 6 Jan 2020 is already on the start of its week
+				So(points[0][1].Float64, ShouldEqual, 1578268800000)
+				// Tuesday 14 Jan 2020 is moved back to Monday 13 Jan 2020
+				So(points[1][1].Float64, ShouldEqual, 1578873600000)
+			})
+
+			Convey("Should truncate months and years to their calendar start", func() {
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "doc_count": 1, "key": 1522533600000 },
+                    { "doc_count": 2, "key": 1525129200000 }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(target("1M", "Europe/Berlin"), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				// 1 Apr 00:00 CEST is kept and 1 May 01:00 CEST is moved to 1 May 00:00 CEST
+				points := result.Results["A"].Series[0].Points
+				So(points[0][1].Float64, ShouldEqual, 1522533600000)
+				So(points[1][1].Float64, ShouldEqual, 1525125600000)
+
+				response = `{
+          "responses": [
+            { "aggregations": { "2": { "buckets": [{ "doc_count": 1, "key": 1561939200000 }] } } }
+          ]
+				}`
+				rp, err = newResponseParserForTest(target("1y", ""), response)
+				So(err, ShouldBeNil)
+				result, err = rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				// 1 Jul 2019 is moved to 1 Jan 2019
+				So(result.Results["A"].Series[0].Points[0][1].Float64, ShouldEqual, 1546300800000)
+			})
+
+			Convey("Should fail on an invalid time zone", func() {
+				response := `{
+          "responses": [
+            { "aggregations": { "2": { "buckets": [{ "doc_count": 1, "key": 1000 }] } } }
+          ]
+				}`
+				rp, err := newResponseParserForTest(target("1d", "Mars/Olympus"), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].ErrorString, ShouldEqual, `invalid time zone "Mars/Olympus"`)
+			})
+
+			Convey("Should not collapse distinct buckets", func() {
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "doc_count": 1, "key": 1521849600000 },
+                    { "doc_count": 2, "key": 1521892800000 }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(target("1d", ""), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				points := result.Results["A"].Series[0].Points
+				So(points, ShouldHaveLength, 2)
+				So(points[0][1].Float64, ShouldEqual, 1521849600000)
+				So(points[1][1].Float64, ShouldEqual, 1521892800000)
+			})
+
+			Convey("Should fail on an invalid interval", func() {
+				response := `{
+          "responses": [
+            { "aggregations": { "2": { "buckets": [{ "doc_count": 1, "key": 1000 }] } } }
+          ]
+				}`
+				rp, err := newResponseParserForTest(target("daily", ""), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].ErrorString, ShouldEqual, `invalid align interval "daily"`)
+
+				rp, err = newResponseParserForTest(target("2w", ""), response)
+				So(err, ShouldBeNil)
+				result, err = rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].ErrorString, ShouldEqual, `invalid align interval "2w"`)
+			})
+		})
+
+		Convey("Hits total in meta", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := func(total string) string {
+				return `{
+          "responses": [
+            {
+              "hits": { "total": ` + total + `, "hits": [] },
+              "aggregations": { "2": { "buckets": [{ "doc_count": 10, "key": 1000 }] } }
+            }
+          ]
+				}`
+			}
+
+			Convey("Should read the integer total of older versions", func() {
+				rp, err := newResponseParserForTest(targets, response("42"))
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				meta := result.Results["A"].Meta
+				So(meta.Get("hitsTotal").MustInt64(), ShouldEqual, 42)
+				So(meta.Get("hitsTotalRelation").MustString(), ShouldEqual, "eq")
+			})
+
+			Convey("Should read the total object with its relation", func() {
+				rp, err := newResponseParserForTest(targets, response(`{ "value": 10000, "relation": "gte" }`))
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				meta := result.Results["A"].Meta
+				So(meta.Get("hitsTotal").MustInt64(), ShouldEqual, 10000)
+				So(meta.Get("hitsTotalRelation").MustString(), ShouldEqual, "gte")
+			})
+		})
+
+		Convey("Values rounded to significant digits", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"significantDigits": 3,
+					"metrics": [{ "type": "avg", "field": "temperature", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "1": { "value": 21.299999999999997 }, "doc_count": 1, "key": 1000 },
+                  { "1": { "value": 0.000012345 }, "doc_count": 1, "key": 2000 },
+                  { "1": { "value": 123456 }, "doc_count": 1, "key": 3000 },
+                  { "1": { "value": null }, "doc_count": 0, "key": 4000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			points := result.Results["A"].Series[0].Points
+			So(points, ShouldHaveLength, 4)
+			So(points[0][0].Float64, ShouldEqual, 21.3)
+			So(points[1][0].Float64, ShouldEqual, 0.0000123)
+			So(points[2][0].Float64, ShouldEqual, 123000)
+			So(points[3][0].Valid, ShouldBeFalse)
+		})
+
+		Convey("Descending time order", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "doc_count": 10, "key": 1000 },
+                  { "doc_count": 15, "key": 2000 },
+                  { "doc_count": 20, "key": 3000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should reverse series points", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"timeOrder": "desc",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				points := result.Results["A"].Series[0].Points
+				So(points, ShouldHaveLength, 3)
+				So(points[0][1].Float64, ShouldEqual, 3000)
+				So(points[0][0].Float64, ShouldEqual, 20)
+				So(points[2][1].Float64, ShouldEqual, 1000)
+			})
+
+			Convey("Should reverse wide table rows", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"timeOrder": "desc",
+						"output": "wide",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				rows := result.Results["A"].Tables[0].Rows
+				So(rows, ShouldHaveLength, 3)
+				So(rows[0][0].(null.Float).Float64, ShouldEqual, 3000)
+				So(rows[2][0].(null.Float).Float64, ShouldEqual, 1000)
+			})
+		})
+
+		Convey("Categorize text patterns", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 4, "key": 1000 }] },
+                    "doc_count": 4,
+                    "key": "Node shutting down {{metric}} at port"
+                  },
+                  {
+                    "3": { "buckets": [{ "doc_count": 2, "key": 1000 }] },
+                    "doc_count": 2,
+                    "key": "User logged in from host"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should label series by pattern without templating the pattern", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"alias": "{{term message}}: {{metric}}",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "categorize_text", "field": "message", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 2)
+				So(queryRes.Series[0].Name, ShouldEqual, "Node shutting down {{metric}} at port: Count")
+				So(queryRes.Series[1].Name, ShouldEqual, "User logged in from host: Count")
+			})
+
+			Convey("Should return a table of categories", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "categorize_text", "field": "message", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 2)
+				So(table.Columns[0].Text, ShouldEqual, "message")
+				So(table.Columns[1].Text, ShouldEqual, "Count")
+				So(table.Rows, ShouldHaveLength, 2)
+				So(table.Rows[0][0], ShouldEqual, "Node shutting down {{metric}} at port")
+				So(table.Rows[1][1].(null.Float).Float64, ShouldEqual, 2)
+			})
+		})
+
+		Convey("Columns per term output", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"output": "columnsPerTerm",
+					"columnsMetric": "4",
+					"metrics": [{ "type": "count", "id": "1" }, { "type": "avg", "field": "cpu", "id": "4" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": {
+                      "buckets": [
+                        { "4": { "value": 10 }, "doc_count": 1, "key": 1000 },
+                        { "4": { "value": 20 }, "doc_count": 1, "key": 2000 }
+                      ]
+                    },
+                    "doc_count": 2,
+                    "key": "server1"
+                  },
+                  {
+                    "3": {
+                      "buckets": [
+                        { "4": { "value": 30 }, "doc_count": 1, "key": 2000 }
+                      ]
+                    },
+                    "doc_count": 1,
+                    "key": "server2"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 0)
+			So(queryRes.Tables, ShouldHaveLength, 1)
+
+			table := queryRes.Tables[0]
+			So(table.Columns, ShouldHaveLength, 3)
+			So(table.Columns[0].Text, ShouldEqual, "Time")
+			So(table.Columns[1].Text, ShouldEqual, "server1")
+			So(table.Columns[2].Text, ShouldEqual, "server2")
+
+			So(table.Rows, ShouldHaveLength, 2)
+			So(table.Rows[0][0].(null.Float).Float64, ShouldEqual, 1000)
+			So(table.Rows[0][1].(null.Float).Float64, ShouldEqual, 10)
+			So(table.Rows[0][2].(null.Float).Valid, ShouldBeFalse)
+			So(table.Rows[1][1].(null.Float).Float64, ShouldEqual, 20)
+			So(table.Rows[1][2].(null.Float).Float64, ShouldEqual, 30)
+		})
+
+		Convey("Duplicate bucket aggregation ids", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": { "buckets": [{ "doc_count": 1, "key": 1000 }] }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should return an error", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "2" }
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				_, err = rp.getTimeSeries()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "id 2")
+			})
+
+			Convey("Should allow metrics sharing an id with a bucket aggregation", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "2" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].Series, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("Aggregation meta", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "meta": { "team": "infra" },
+                "buckets": [
+                  {
+                    "3": { "meta": { "panel": "cpu" }, "buckets": [{ "doc_count": 1, "key": 1000 }] },
+                    "doc_count": 1,
+                    "key": "server1"
+                  },
+                  {
+                    "3": { "meta": { "panel": "cpu" }, "buckets": [{ "doc_count": 2, "key": 1000 }] },
+                    "doc_count": 2,
+                    "key": "server2"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+			So(queryRes.Meta.GetPath("aggregationMeta", "2", "team").MustString(), ShouldEqual, "infra")
+			So(queryRes.Meta.GetPath("aggregationMeta", "3", "panel").MustString(), ShouldEqual, "cpu")
+		})
+
+		Convey("Stats metric", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "1": { "count": 4, "min": 1, "max": 7, "avg": 3.5, "sum": 14 }, "doc_count": 4, "key": 1000 },
+                  { "1": { "count": 0, "min": null, "max": null, "avg": null, "sum": 0 }, "doc_count": 0, "key": 2000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should return a series per enabled value", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "stats", "field": "load", "meta": { "max": true, "min": true, "sum": false }, "id": "1" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 2)
+				So(queryRes.Series[0].Name, ShouldEqual, "Max load")
+				So(queryRes.Series[0].Points[0][0].Float64, ShouldEqual, 7)
+				So(queryRes.Series[0].Points[1][0].Valid, ShouldBeFalse)
+				So(queryRes.Series[1].Name, ShouldEqual, "Min load")
+				So(queryRes.Series[1].Points[0][0].Float64, ShouldEqual, 1)
+				So(rp.estimateSeriesCount(rp.Targets[0], rp.Responses[0]), ShouldEqual, 2)
+			})
+
+			Convey("Should default to the average", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "stats", "field": "load", "id": "1" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 1)
+				So(queryRes.Series[0].Name, ShouldEqual, "Average load")
+				So(queryRes.Series[0].Points[0][0].Float64, ShouldEqual, 3.5)
+			})
+		})
+
+		Convey("Keyed and unkeyed buckets in the same response", func() {
+			Convey("Should classify each aggregation independently", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "filters", "id": "2", "settings": { "filters": [{ "query": "level:error", "label": "" }] } },
+							{ "type": "terms", "field": "host", "id": "3" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "4" }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": {
+                    "level:error": {
+                      "3": {
+                        "buckets": [
+                          { "4": { "buckets": [{ "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": "server1" },
+                          { "4": { "buckets": {} }, "doc_count": 0, "key": "server2" }
+                        ]
+                      },
+                      "doc_count": 1
+                    },
+                    "level:warn": {
+                      "3": { "buckets": {} },
+                      "doc_count": 0
+                    }
+                  }
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 2)
+				So(queryRes.Series[0].Tags["filter"], ShouldEqual, "level:error")
+				So(queryRes.Series[0].Tags["host"], ShouldEqual, "server1")
+				So(queryRes.Series[0].Points, ShouldHaveLength, 1)
+				So(queryRes.Series[1].Tags["filter"], ShouldEqual, "level:error")
+				So(queryRes.Series[1].Tags["host"], ShouldEqual, "server2")
+				So(queryRes.Series[1].Points, ShouldHaveLength, 0)
+			})
+
+			Convey("Should read keyed buckets of the last aggregation into a table", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "filters", "id": "3", "settings": { "filters": [{ "query": "level:error" }, { "query": "level:warn" }] } }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    {
+                      "3": { "buckets": { "level:error": { "doc_count": 2 }, "level:warn": { "doc_count": 5 } } },
+                      "doc_count": 7,
+                      "key": "server1"
+                    },
+                    {
+                      "3": { "buckets": null },
+                      "doc_count": 0,
+                      "key": "server2"
+                    }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Rows, ShouldHaveLength, 2)
+				So(table.Rows[0][0], ShouldEqual, "server1")
+				So(table.Rows[0][1], ShouldEqual, "level:error")
+				So(table.Rows[0][2].(null.Float).Float64, ShouldEqual, 2)
+				So(table.Rows[1][1], ShouldEqual, "level:warn")
+				So(table.Rows[1][2].(null.Float).Float64, ShouldEqual, 5)
+			})
+		})
+
+		Convey("Bucket script referencing hidden metrics", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "1": { "value": 2 },
+                    "3": { "value": 3 },
+                    "4": { "value": 6 },
+                    "doc_count": 60,
+                    "key": 1000
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should name the bucket script after its hidden parents", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [
+							{ "id": "1", "type": "sum", "field": "@value", "hide": true },
+							{ "id": "3", "type": "max", "field": "@value", "hide": true },
+							{
+								"id": "4",
+								"pipelineVariables": [{ "name": "var1", "pipelineAgg": "1" }, { "name": "var2", "pipelineAgg": "3" }],
+								"settings": { "script": "params.var1 * params.var2" },
+								"type": "bucket_script"
+							}
+						],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 1)
+				So(queryRes.Series[0].Name, ShouldEqual, "Sum @value * Max @value")
+				So(queryRes.Series[0].Points[0][0].Float64, ShouldEqual, 6)
+			})
+
+			Convey("Should leave hidden parents out of tables", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [
+							{ "id": "1", "type": "sum", "field": "@value", "hide": true },
+							{ "id": "3", "type": "max", "field": "@value", "hide": true },
+							{
+								"id": "4",
+								"pipelineVariables": [{ "name": "var1", "pipelineAgg": "1" }, { "name": "var2", "pipelineAgg": "3" }],
+								"settings": { "script": "params.var1 * params.var2" },
+								"type": "bucket_script"
+							}
+						],
+						"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+					}`,
+				}
+				tableResponse := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [{ "1": { "value": 2 }, "3": { "value": 3 }, "4": { "value": 6 }, "doc_count": 60, "key": "server1" }]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, tableResponse)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 2)
+				So(table.Columns[0].Text, ShouldEqual, "host")
+				So(table.Columns[1].Text, ShouldEqual, "Bucket Script")
+				So(table.Rows, ShouldHaveLength, 1)
+				So(table.Rows[0][1].(null.Float).Float64, ShouldEqual, 6)
+			})
+
+			Convey("Should build columns per term from a bucket script with hidden parents", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"output": "columnsPerTerm",
+						"columnsMetric": "4",
+						"metrics": [
+							{ "id": "1", "type": "sum", "field": "@value", "hide": true },
+							{ "id": "3", "type": "max", "field": "@value", "hide": true },
+							{
+								"id": "4",
+								"pipelineVariables": [{ "name": "var1", "pipelineAgg": "1" }, { "name": "var2", "pipelineAgg": "3" }],
+								"settings": { "script": "params.var1 * params.var2" },
+								"type": "bucket_script"
+							}
+						],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "5" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "2" }
+						]
+					}`,
+				}
+				columnsResponse := `{
+          "responses": [
+            {
+              "aggregations": {
+                "5": {
+                  "buckets": [{ "2": { "buckets": [{ "4": { "value": 6 }, "doc_count": 60, "key": 1000 }] }, "doc_count": 60, "key": "server1" }]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, columnsResponse)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 2)
+				So(table.Columns[1].Text, ShouldEqual, "server1")
+				So(table.Rows[0][1].(null.Float).Float64, ShouldEqual, 6)
+			})
+		})
+
+		Convey("Geotile grid", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "doc_count": 1, "key": "0/0/0" },
+                  { "doc_count": 2, "key": "1/1/0" },
+                  { "doc_count": 3, "key": "29/268435456/268435456" },
+                  { "doc_count": 4, "key": "2/4/0" },
+                  { "doc_count": 5, "key": "invalid" }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should decode tiles to their center", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "geotile_grid", "field": "location", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 4)
+				So(table.Columns[0].Text, ShouldEqual, "location")
+				So(table.Columns[1].Text, ShouldEqual, "lat")
+				So(table.Columns[2].Text, ShouldEqual, "lon")
+				So(table.Columns[3].Text, ShouldEqual, "Count")
+				So(table.Rows, ShouldHaveLength, 5)
+
+				So(table.Rows[0][0], ShouldEqual, "0/0/0")
+				So(table.Rows[0][1].(null.Float).Float64, ShouldAlmostEqual, 0, 0.0001)
+				So(table.Rows[0][2].(null.Float).Float64, ShouldAlmostEqual, 0, 0.0001)
+
+				So(table.Rows[1][1].(null.Float).Float64, ShouldAlmostEqual, 66.5133, 0.0001)
+				So(table.Rows[1][2].(null.Float).Float64, ShouldAlmostEqual, 90, 0.0001)
+
+				So(table.Rows[2][1].(null.Float).Float64, ShouldAlmostEqual, 0, 0.0001)
+				So(table.Rows[2][2].(null.Float).Float64, ShouldAlmostEqual, 0, 0.0001)
+				So(table.Rows[2][3].(null.Float).Float64, ShouldEqual, 3)
+
+				for _, row := range table.Rows[3:] {
+					So(row[1].(null.Float).Valid, ShouldBeFalse)
+					So(row[2].(null.Float).Valid, ShouldBeFalse)
+				}
+				So(table.Rows[4][3].(null.Float).Float64, ShouldEqual, 5)
+			})
+
+			Convey("Should decode tile bounds when enabled", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "geotile_grid", "field": "location", "id": "2", "settings": { "bounds": true } }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 8)
+				So(table.Columns[3].Text, ShouldEqual, "top")
+				So(table.Columns[6].Text, ShouldEqual, "right")
+
+				row := table.Rows[1]
+				So(row[3].(null.Float).Float64, ShouldAlmostEqual, 85.0511, 0.0001)
+				So(row[4].(null.Float).Float64, ShouldAlmostEqual, 0, 0.0001)
+				So(row[5].(null.Float).Float64, ShouldAlmostEqual, 0, 0.0001)
+				So(row[6].(null.Float).Float64, ShouldAlmostEqual, 180, 0.0001)
+				So(table.Rows[4][3].(null.Float).Valid, ShouldBeFalse)
+			})
+		})
+
+		Convey("Row limit", func() {
+			Convey("Should truncate table rows and report it in meta", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"maxRows": 3,
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "terms", "field": "level", "id": "3" }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "3": { "buckets": [{ "doc_count": 1, "key": "info" }, { "doc_count": 2, "key": "warn" }] }, "doc_count": 3, "key": "server1" },
+                    { "3": { "buckets": [{ "doc_count": 3, "key": "info" }, { "doc_count": 4, "key": "warn" }] }, "doc_count": 7, "key": "server2" },
+                    { "3": { "buckets": [{ "doc_count": 5, "key": "info" }] }, "doc_count": 5, "key": "server3" }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				rows := queryRes.Tables[0].Rows
+				So(rows, ShouldHaveLength, 3)
+				So(rows[2][0], ShouldEqual, "server2")
+				So(rows[2][1], ShouldEqual, "info")
+
+				So(queryRes.Meta.Get("truncated").MustBool(), ShouldBeTrue)
+				So(queryRes.Meta.Get("notices").MustArray(), ShouldHaveLength, 1)
+			})
+
+			Convey("Should truncate series points and report it in meta", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"maxRows": 2,
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "doc_count": 1, "key": 1000 },
+                    { "doc_count": 2, "key": 2000 },
+                    { "doc_count": 3, "key": 3000 }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series[0].Points, ShouldHaveLength, 2)
+				So(queryRes.Series[0].Points[1][1].Float64, ShouldEqual, 2000)
+				So(queryRes.Meta.Get("truncated").MustBool(), ShouldBeTrue)
+			})
+
+			Convey("Should limit the points of all series of the target", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"maxRows": 3,
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "3": { "buckets": [{ "doc_count": 1, "key": 1000 }, { "doc_count": 2, "key": 2000 }] }, "doc_count": 3, "key": "server1" },
+                    { "3": { "buckets": [{ "doc_count": 3, "key": 1000 }, { "doc_count": 4, "key": 2000 }] }, "doc_count": 7, "key": "server2" }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 2)
+				So(queryRes.Series[0].Points, ShouldHaveLength, 2)
+				So(queryRes.Series[1].Points, ShouldHaveLength, 1)
+				So(queryRes.Series[1].Points[0][0].Float64, ShouldEqual, 3)
+				So(queryRes.Meta.Get("truncated").MustBool(), ShouldBeTrue)
+			})
+
+			Convey("Should truncate geo_line rows", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"maxRows": 2,
+						"metrics": [{ "type": "geo_line", "field": "location", "id": "1" }],
+						"bucketAggs": [{ "type": "terms", "field": "vehicle", "id": "2" }]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "1": { "geometry": { "coordinates": [[4.9, 52.3], [4.91, 52.31]] } }, "key": "bus-1", "doc_count": 2 },
+                    { "1": { "geometry": { "coordinates": [[2.35, 48.85]] } }, "key": "bus-2", "doc_count": 1 }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Tables[0].Rows, ShouldHaveLength, 2)
+				So(queryRes.Tables[0].Rows[1][0], ShouldEqual, "bus-1")
+				So(queryRes.Meta.Get("truncated").MustBool(), ShouldBeTrue)
+			})
+
+			Convey("Should truncate heatmap rows", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"output": "heatmap",
+						"maxRows": 1,
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "date_histogram", "field": "@timestamp", "id": "2" },
+							{ "type": "histogram", "field": "bytes", "id": "3" }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "3": { "buckets": [{ "doc_count": 1, "key": 0 }] }, "doc_count": 1, "key": 1000 },
+                    { "3": { "buckets": [{ "doc_count": 2, "key": 0 }] }, "doc_count": 2, "key": 2000 }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Tables[0].Rows, ShouldHaveLength, 1)
+				So(queryRes.Tables[0].Rows[0][0].(null.Float).Float64, ShouldEqual, 1000)
+				So(queryRes.Meta.Get("truncated").MustBool(), ShouldBeTrue)
+			})
+
+			Convey("Should not report results within the limit", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"maxRows": 2,
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": { "buckets": [{ "doc_count": 1, "key": 1000 }, { "doc_count": 2, "key": 2000 }] }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series[0].Points, ShouldHaveLength, 2)
+				_, truncated := queryRes.Meta.CheckGet("truncated")
+				So(truncated, ShouldBeFalse)
+			})
+		})
+
+		Convey("Diversified sampler", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2" },
+						{ "type": "diversified_sampler", "field": "user", "id": "3", "settings": { "max_docs_per_value": 2 } },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "4" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": {
+                      "4": { "buckets": [{ "doc_count": 1, "key": 1000 }, { "doc_count": 2, "key": 2000 }] },
+                      "doc_count": 3
+                    },
+                    "doc_count": 10,
+                    "key": "server1"
+                  },
+                  {
+                    "3": {
+                      "4": { "buckets": [{ "doc_count": 4, "key": 1000 }] },
+                      "doc_count": 4
+                    },
+                    "doc_count": 8,
+                    "key": "server2"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+			So(queryRes.Series[0].Name, ShouldEqual, "server1")
+			So(queryRes.Series[0].Points, ShouldHaveLength, 2)
+			So(queryRes.Series[1].Name, ShouldEqual, "server2")
+			So(queryRes.Series[1].Points[0][0].Float64, ShouldEqual, 4)
+
+			sampler := queryRes.Meta.GetPath("diversifiedSampler", "3")
+			So(sampler.Get("field").MustString(), ShouldEqual, "user")
+			So(sampler.Get("max_docs_per_value").MustInt64(), ShouldEqual, 2)
+		})
+
+		Convey("Malformed buckets", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 1, "key": 1000 }, { "doc_count": 2, "key": 2000 }] },
+                    "doc_count": 3,
+                    "key": "server1"
+                  },
+                  "malformed",
+                  {
+                    "3": { "buckets": [{ "doc_count": 4, "key": 1000 }, 5] },
+                    "doc_count": 4,
+                    "key": "server2"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should parse malformed buckets as empty buckets by default", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.ErrorString, ShouldBeEmpty)
+				So(queryRes.Series, ShouldHaveLength, 2)
+				So(queryRes.Series[0].Name, ShouldEqual, "server1")
+				So(queryRes.Series[1].Name, ShouldEqual, "server2")
+				So(queryRes.Series[1].Points, ShouldHaveLength, 2)
+				So(queryRes.Meta.Get("notices").MustArray(), ShouldBeEmpty)
+			})
+
+			Convey("Should skip malformed buckets with lenient parsing", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"lenientParsing": true,
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 2)
+				So(queryRes.Series[0].Name, ShouldEqual, "server1")
+				So(queryRes.Series[0].Points, ShouldHaveLength, 2)
+				So(queryRes.Series[1].Name, ShouldEqual, "server2")
+				So(queryRes.Series[1].Points, ShouldHaveLength, 1)
+
+				notices := queryRes.Meta.Get("notices").MustArray()
+				So(notices, ShouldHaveLength, 2)
+				So(notices[0], ShouldEqual, "skipped bucket 1 of aggregation 2, bucket is not an object")
+				So(notices[1], ShouldEqual, "skipped bucket 1 of aggregation 3, bucket is not an object")
+			})
+
+			Convey("Should fail the target on malformed aggregations with lenient parsing", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"lenientParsing": true,
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": { "buckets": "malformed" }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.ErrorString, ShouldEqual, "buckets of aggregation 2 are neither an array nor an object")
+				So(queryRes.Series, ShouldBeEmpty)
+			})
+
+			Convey("Should keep the series parsed before an error with lenient parsing", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"lenientParsing": true,
+						"strictTermAccuracy": true,
+						"alias": "{{host}} {{level}}",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "terms", "field": "level", "id": "3" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "4" }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    {
+                      "3": { "buckets": [{ "4": { "buckets": [{ "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": "error" }] },
+                      "doc_count": 1,
+                      "key": "server1"
+                    },
+                    {
+                      "3": {
+                        "doc_count_error_upper_bound": 5,
+                        "buckets": [{ "4": { "buckets": [{ "doc_count": 2, "key": 1000 }] }, "doc_count": 2, "key": "error" }]
+                      },
+                      "doc_count": 2,
+                      "key": "server2"
+                    }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.ErrorString, ShouldBeEmpty)
+				So(queryRes.Series, ShouldHaveLength, 1)
+				So(queryRes.Series[0].Name, ShouldEqual, "server1 error")
+
+				notices := queryRes.Meta.Get("notices").MustArray()
+				So(notices, ShouldHaveLength, 1)
+				So(notices[0], ShouldEqual, "parsing stopped early: terms aggregation on level has a doc count error of up to 5, above the allowed 0")
+			})
+		})
+
+		Convey("Metrics with a missing value", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [
+						{ "type": "avg", "field": "load", "id": "1", "settings": { "missing": 0 } },
+						{ "type": "sum", "field": "load", "id": "3", "settings": { "missing": 10 } },
+						{ "type": "max", "field": "load", "id": "4" }
+					],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [{ "1": { "value": 1 }, "3": { "value": 12 }, "4": { "value": 2 }, "doc_count": 3, "key": 1000 }]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 3)
+
+			missingValues := queryRes.Meta.Get("missingValues")
+			So(missingValues.MustMap(), ShouldHaveLength, 2)
+			So(missingValues.Get("1").MustFloat64(), ShouldEqual, 0)
+			So(missingValues.Get("3").MustFloat64(), ShouldEqual, 10)
+			_, ok := missingValues.CheckGet("4")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Trim leading and trailing zero counts", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": {
+                      "buckets": [
+                        { "4": { "value": 0 }, "doc_count": 0, "key": 1000 },
+                        { "4": { "value": 5 }, "doc_count": 2, "key": 2000 },
+                        { "4": { "value": 0 }, "doc_count": 0, "key": 3000 },
+                        { "4": { "value": 5 }, "doc_count": 1, "key": 4000 },
+                        { "4": { "value": 0 }, "doc_count": 0, "key": 5000 }
+                      ]
+                    },
+                    "doc_count": 3,
+                    "key": "server1"
+                  },
+                  {
+                    "3": {
+                      "buckets": [
+                        { "doc_count": 0, "key": 1000 },
+                        { "doc_count": 0, "key": 2000 }
+                      ]
+                    },
+                    "doc_count": 0,
+                    "key": "server2"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should trim zero counts at the edges only", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3", "settings": { "trimLeadingTrailingZeros": true } }
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series, ShouldHaveLength, 2)
+				points := queryRes.Series[0].Points
+				So(points, ShouldHaveLength, 3)
+				So(points[0][1].Float64, ShouldEqual, 2000)
+				So(points[1][0].Float64, ShouldEqual, 0)
+				So(points[2][1].Float64, ShouldEqual, 4000)
+				So(queryRes.Series[1].Points, ShouldHaveLength, 0)
+			})
+
+			Convey("Should keep one datapoint of all zero series when enabled", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3", "settings": { "trimLeadingTrailingZeros": true, "trimZerosKeepOne": true } }
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Series[0].Points, ShouldHaveLength, 3)
+				So(queryRes.Series[1].Points, ShouldHaveLength, 1)
+				So(queryRes.Series[1].Points[0][1].Float64, ShouldEqual, 1000)
+			})
+
+			Convey("Should leave other metrics untouched", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "avg", "field": "load", "id": "4" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3", "settings": { "trimLeadingTrailingZeros": true } }
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				So(result.Results["A"].Series[0].Points, ShouldHaveLength, 5)
+			})
+		})
+
+		Convey("With bucket_selector", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"missingCountAs": "zero",
+					"metrics": [
+						{ "type": "count", "id": "1" },
+						{
+							"id": "4",
+							"type": "bucket_selector",
+							"pipelineVariables": [{ "name": "var1", "pipelineAgg": "1" }],
+							"settings": { "script": "params.var1 > 1" }
+						}
+					],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "doc_count": 2, "key": 1000 }, { "doc_count": 3, "key": 2000 }] },
+                    "doc_count": 5,
+                    "key": "server1"
+                  },
+                  {
+                    "3": { "buckets": [{ "doc_count": 4, "key": 2000 }] },
+                    "doc_count": 5,
+                    "key": "server2"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+			So(queryRes.Series[0].Name, ShouldEqual, "server1")
+			So(queryRes.Series[0].Points, ShouldHaveLength, 2)
+			So(queryRes.Series[1].Name, ShouldEqual, "server2")
+			So(queryRes.Series[1].Points, ShouldHaveLength, 1)
+			So(queryRes.Series[1].Points[0][1].Float64, ShouldEqual, 2000)
+
+			So(queryRes.Meta.Get("bucketSelectors").MustArray(), ShouldResemble, []interface{}{"4"})
+		})
+
+		Convey("Anonymous filters returned as an object", func() {
+			buckets := make([]string, 0, 12)
+			for i := 0; i < 12; i++ {
+				buckets = append(buckets, fmt.Sprintf(`"%d": { "3": { "buckets": [{ "doc_count": %d, "key": 1000 }] }, "doc_count": %d }`, i, i, i))
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": {` + strings.Join(buckets, ",") + `}
+              }
+            }
+          }
+        ]
+			}`
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "filters", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`,
+			}
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			series := result.Results["A"].Series
+			So(series, ShouldHaveLength, 12)
+			for i, s := range series {
+				So(s.Name, ShouldEqual, strconv.Itoa(i))
+				So(s.Points[0][0].Float64, ShouldEqual, i)
+			}
+		})
+
+		Convey("Filters returned as an array", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] }, "doc_count": 1 },
+                  { "3": { "buckets": [{ "doc_count": 2, "key": 1000 }] }, "doc_count": 2 },
+                  { "3": { "buckets": [{ "doc_count": 3, "key": 1000 }] }, "doc_count": 3 },
+                  { "3": { "buckets": [{ "doc_count": 4, "key": 1000 }] }, "doc_count": 4 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			filters := `[
+				{ "query": "level:error", "label": "Errors" },
+				{ "query": "level:warn", "label": "" },
+				{ "query": "", "label": "" }
+			]`
+
+			Convey("Should label series by filter definition or position", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "filters", "id": "2", "settings": { "filters": ` + filters + ` } },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 4)
+				So(series[0].Name, ShouldEqual, "Errors")
+				So(series[1].Name, ShouldEqual, "level:warn")
+				So(series[2].Name, ShouldEqual, "2")
+				So(series[3].Name, ShouldEqual, "3")
+				So(series[3].Points[0][0].Float64, ShouldEqual, 4)
+			})
+
+			Convey("Should label table rows by filter definition or position", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "filters", "id": "2", "settings": { "filters": ` + filters + ` } }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				rows := result.Results["A"].Tables[0].Rows
+				So(rows, ShouldHaveLength, 4)
+				So(rows[0][0], ShouldEqual, "Errors")
+				So(rows[1][0], ShouldEqual, "level:warn")
+				So(rows[2][0], ShouldEqual, "2")
+				So(rows[3][0], ShouldEqual, "3")
+				So(rows[3][1].(null.Float).Float64, ShouldEqual, 4)
+			})
+		})
+
+		Convey("Terms execution hints", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2", "settings": { "execution_hint": "global_ordinals" } },
+						{ "type": "terms", "field": "level", "id": "3" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "4" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": { "buckets": [{ "4": { "buckets": [{ "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": "error" }] },
+                    "doc_count": 1,
+                    "key": "server1"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			hints := result.Results["A"].Meta.Get("executionHints")
+			So(hints.Get("2").MustString(), ShouldEqual, "global_ordinals")
+			So(hints.Get("3").MustString(), ShouldEqual, "default")
+		})
+
+		Convey("Terms collect modes", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2", "settings": { "collect_mode": "breadth_first" } },
+						{ "type": "terms", "field": "level", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [{ "3": { "buckets": [{ "doc_count": 1, "key": "error" }] }, "doc_count": 1, "key": "server1" }]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			modes := result.Results["A"].Meta.Get("collectModes")
+			So(modes.Get("2").MustString(), ShouldEqual, "breadth_first")
+			So(modes.Get("3").MustString(), ShouldEqual, "depth_first")
+		})
+
+		Convey("Coalesce series with identical tags", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "3": { "buckets": [{ "doc_count": 1, "key": 1000 }, { "doc_count": 2, "key": 2000 }] }, "doc_count": 3 },
+                  { "3": { "buckets": [{ "doc_count": 3, "key": 2000 }, { "doc_count": 4, "key": 3000 }] }, "doc_count": 7 },
+                  { "3": { "buckets": [{ "doc_count": 5, "key": 1000 }] }, "doc_count": 5 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			newTarget := func(mode string) string {
+				return `{
+					"timeField": "@timestamp",
+					"coalesceSeries": "` + mode + `",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{
+							"type": "filters",
+							"id": "2",
+							"settings": {
+								"filters": [
+									{ "query": "level:error", "label": "errors" },
+									{ "query": "level:error", "label": "errors" },
+									{ "query": "level:warn", "label": "warnings" }
+								]
+							}
+						},
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`
+			}
+
+			Convey("Should keep duplicate series by default", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": newTarget("")}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].Series, ShouldHaveLength, 3)
+			})
+
+			Convey("Should sum points sharing a timestamp", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": newTarget("sum")}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 2)
+				So(series[0].Name, ShouldEqual, "errors")
+				So(series[0].Points, ShouldResemble, tsdb.TimeSeriesPoints{
+					{null.FloatFrom(1), null.FloatFrom(1000)},
+					{null.FloatFrom(5), null.FloatFrom(2000)},
+					{null.FloatFrom(4), null.FloatFrom(3000)},
+				})
+				So(series[1].Name, ShouldEqual, "warnings")
+			})
+
+			Convey("Should keep all points sharing a timestamp", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": newTarget("keep")}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 2)
+				So(series[0].Points, ShouldResemble, tsdb.TimeSeriesPoints{
+					{null.FloatFrom(1), null.FloatFrom(1000)},
+					{null.FloatFrom(2), null.FloatFrom(2000)},
+					{null.FloatFrom(3), null.FloatFrom(2000)},
+					{null.FloatFrom(4), null.FloatFrom(3000)},
+				})
+			})
+		})
+
+		Convey("Matrix stats", func() {
+			matrix := `{
+				"doc_count": 50,
+				"fields": [
+					{
+						"name": "income",
+						"count": 50,
+						"mean": 51985.1,
+						"variance": 7.3E7,
+						"correlation": { "income": 1.0, "poverty": -0.8 }
+					},
+					{
+						"name": "poverty",
+						"count": 50,
+						"mean": 12.7,
+						"variance": 8.1,
+						"correlation": { "income": -0.8, "poverty": 1.0 }
+					}
+				]
+			}`
+
+			Convey("Should return mean and variance series per field", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "matrix_stats", "id": "1", "settings": { "fields": ["income", "poverty", "age"] } }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "1": ` + matrix + `, "doc_count": 50, "key": 1000 },
+                    { "1": { "doc_count": 0, "fields": [] }, "doc_count": 0, "key": 2000 }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 6)
+				So(series[0].Name, ShouldEqual, "Mean income")
+				So(series[0].Points[0][0].Float64, ShouldEqual, 51985.1)
+				So(series[0].Points[1][0].Valid, ShouldBeFalse)
+				So(series[1].Name, ShouldEqual, "Variance income")
+				So(series[1].Points[0][0].Float64, ShouldEqual, 7.3e7)
+				So(series[2].Name, ShouldEqual, "Mean poverty")
+				So(series[3].Points[0][0].Float64, ShouldEqual, 8.1)
+				So(series[4].Name, ShouldEqual, "Mean age")
+				So(series[4].Points[0][0].Valid, ShouldBeFalse)
+			})
+
+			Convey("Should return the correlation matrix as table rows", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "matrix_stats", "id": "1" }],
+						"bucketAggs": [{ "type": "terms", "field": "state", "id": "2" }]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [{ "1": ` + matrix + `, "doc_count": 50, "key": "CA" }]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 7)
+				So(table.Columns[0].Text, ShouldEqual, "state")
+				So(table.Columns[1].Text, ShouldEqual, "field")
+				So(table.Columns[2].Text, ShouldEqual, "Count")
+				So(table.Columns[3].Text, ShouldEqual, "Mean")
+				So(table.Columns[4].Text, ShouldEqual, "Variance")
+				So(table.Columns[5].Text, ShouldEqual, "income")
+				So(table.Columns[6].Text, ShouldEqual, "poverty")
+
+				So(table.Rows, ShouldHaveLength, 2)
+				So(table.Rows[0][0], ShouldEqual, "CA")
+				So(table.Rows[0][1], ShouldEqual, "income")
+				So(table.Rows[0][3].(null.Float).Float64, ShouldEqual, 51985.1)
+				So(table.Rows[0][5].(null.Float).Float64, ShouldEqual, 1)
+				So(table.Rows[0][6].(null.Float).Float64, ShouldEqual, -0.8)
+				So(table.Rows[1][1], ShouldEqual, "poverty")
+				So(table.Rows[1][5].(null.Float).Float64, ShouldEqual, -0.8)
+			})
+
+			Convey("Should truncate correlation matrix rows", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"maxRows": 1,
+						"metrics": [{ "type": "matrix_stats", "id": "1" }],
+						"bucketAggs": [{ "type": "terms", "field": "state", "id": "2" }]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [{ "1": ` + matrix + `, "doc_count": 50, "key": "CA" }]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				queryRes := result.Results["A"]
+				So(queryRes.Tables[0].Rows, ShouldHaveLength, 1)
+				So(queryRes.Tables[0].Rows[0][1], ShouldEqual, "income")
+				So(queryRes.Meta.Get("truncated").MustBool(), ShouldBeTrue)
+			})
+		})
+
+		Convey("Composite with null source values", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "after_key": { "host": null, "level": null },
+                "buckets": [
+                  { "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": { "host": "server1", "level": "error" } },
+                  { "3": { "buckets": [{ "doc_count": 2, "key": 1000 }] }, "doc_count": 2, "key": { "host": "server1", "level": null } },
+                  { "3": { "buckets": [{ "doc_count": 3, "key": 1000 }] }, "doc_count": 3, "key": { "host": null, "level": null } }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should label null values as missing in series", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"alias": "{{host}} {{level}}",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "composite", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 3)
+				So(series[0].Name, ShouldEqual, "server1 error")
+				So(series[1].Name, ShouldEqual, "server1 (missing)")
+				So(series[2].Name, ShouldEqual, "(missing) (missing)")
+			})
+
+			Convey("Should label null values with the configured label in tables", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{
+								"type": "composite",
+								"id": "2",
+								"settings": {
+									"missingLabel": "n/a",
+									"sources": [{ "level": { "terms": { "field": "level" } } }, { "host": { "terms": { "field": "host" } } }]
+								}
+							}
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 3)
+				So(table.Columns[0].Text, ShouldEqual, "level")
+				So(table.Columns[1].Text, ShouldEqual, "host")
+				So(table.Columns[2].Text, ShouldEqual, "Count")
+				So(table.Rows, ShouldHaveLength, 3)
+				So(table.Rows[0][:2], ShouldResemble, tsdb.RowValues{"error", "server1"})
+				So(table.Rows[1][:2], ShouldResemble, tsdb.RowValues{"n/a", "server1"})
+				So(table.Rows[2][:2], ShouldResemble, tsdb.RowValues{"n/a", "n/a"})
+			})
+		})
+
+		Convey("Composite with numeric source values", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": { "day": 1521932400000, "host": "server1" } },
+                  { "3": { "buckets": [{ "doc_count": 2, "key": 1000 }] }, "doc_count": 2, "key": { "day": 1522018800000, "host": "server1" } }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should label numeric values without an exponent in series", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"alias": "{{day}} {{host}}",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "composite", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 2)
+				So(series[0].Name, ShouldEqual, "1521932400000 server1")
+				So(series[1].Name, ShouldEqual, "1522018800000 server1")
+			})
+
+			Convey("Should keep numeric values as numbers in tables", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "composite", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns[0].Text, ShouldEqual, "day")
+				So(table.Rows, ShouldHaveLength, 2)
+				So(table.Rows[0][:2], ShouldResemble, tsdb.RowValues{null.FloatFrom(1521932400000), "server1"})
+				So(table.Rows[1][:2], ShouldResemble, tsdb.RowValues{null.FloatFrom(1522018800000), "server1"})
+			})
+		})
+
+		Convey("Composite under an empty first parent bucket", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [
+						{ "type": "terms", "field": "dc", "id": "2" },
+						{ "type": "composite", "id": "3" }
+					]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "3": { "buckets": [] }, "doc_count": 0, "key": "dc1" },
+                  {
+                    "3": {
+                      "buckets": [
+                        { "doc_count": 4, "key": { "host": "server1", "level": "error" } },
+                        { "doc_count": 6, "key": { "host": "server2", "level": "info" } }
+                      ]
+                    },
+                    "doc_count": 10,
+                    "key": "dc2"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			table := result.Results["A"].Tables[0]
+			So(table.Columns, ShouldHaveLength, 4)
+			So(table.Columns[0].Text, ShouldEqual, "dc")
+			So(table.Columns[1].Text, ShouldEqual, "host")
+			So(table.Columns[2].Text, ShouldEqual, "level")
+			So(table.Columns[3].Text, ShouldEqual, "Count")
+			So(table.Rows, ShouldHaveLength, 2)
+			So(table.Rows[0][:3], ShouldResemble, tsdb.RowValues{"dc2", "server1", "error"})
+			So(table.Rows[0][3].(null.Float).Float64, ShouldEqual, 4)
+			So(table.Rows[1][:3], ShouldResemble, tsdb.RowValues{"dc2", "server2", "info"})
+			So(table.Rows[1][3].(null.Float).Float64, ShouldEqual, 6)
+		})
+
+		Convey("Histogram integer keys", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "3": { "buckets": [{ "doc_count": 1, "key": "a" }] }, "doc_count": 1, "key": 10.0 },
+                  { "3": { "buckets": [{ "doc_count": 2, "key": "b" }] }, "doc_count": 2, "key": 20.0 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			newTargets := func(interval string) map[string]string {
+				return map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "histogram", "field": "bytes", "id": "2", "settings": { "interval": "` + interval + `", "integerKeys": true } },
+							{ "type": "terms", "field": "host", "id": "3" }
+						]
+					}`,
+				}
+			}
+
+			Convey("Should keep keys as integers", func() {
+				rp, err := newResponseParserForTest(newTargets("10"), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				rows := result.Results["A"].Tables[0].Rows
+				So(rows, ShouldHaveLength, 2)
+				So(rows[0][0], ShouldEqual, int64(10))
+				So(rows[1][0], ShouldEqual, int64(20))
+			})
+
+			Convey("Should keep float keys for fractional intervals", func() {
+				rp, err := newResponseParserForTest(newTargets("0.5"), response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				rows := result.Results["A"].Tables[0].Rows
+				So(rows[0][0], ShouldResemble, null.FloatFrom(10))
+			})
+
+			Convey("Should keep integer keys of terminal histograms", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "histogram", "field": "bytes", "id": "2", "settings": { "interval": 10, "integerKeys": true } }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				rows := result.Results["A"].Tables[0].Rows
+				So(rows[0][0], ShouldEqual, int64(10))
+				So(rows[1][0], ShouldEqual, int64(20))
+			})
+		})
+
+		Convey("Formatted key column", func() {
+			Convey("Should add a formatted column for date histograms in tables", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "date_histogram", "field": "@timestamp", "id": "2", "settings": { "formattedKeyColumn": true } },
+							{ "type": "terms", "field": "host", "id": "3" }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    {
+                      "3": { "buckets": [{ "doc_count": 1, "key": "server1" }] },
+                      "doc_count": 1,
+                      "key": 1000,
+                      "key_as_string": "1970-01-01T00:00:01"
+                    },
+                    {
+                      "3": { "buckets": [{ "doc_count": 2, "key": "server2" }] },
+                      "doc_count": 2,
+                      "key": 2000,
+                      "key_as_string": "1970-01-01T00:00:02"
+                    }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 4)
+				So(table.Columns[0].Text, ShouldEqual, "@timestamp")
+				So(table.Columns[1].Text, ShouldEqual, "@timestamp formatted")
+				So(table.Columns[2].Text, ShouldEqual, "host")
+				So(table.Rows, ShouldHaveLength, 2)
+				So(table.Rows[0][:3], ShouldResemble, tsdb.RowValues{null.FloatFrom(1000), "1970-01-01T00:00:01", "server1"})
+				So(table.Rows[1][:3], ShouldResemble, tsdb.RowValues{null.FloatFrom(2000), "1970-01-01T00:00:02", "server2"})
+			})
+
+			Convey("Should add a formatted column for terminal buckets", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "terms", "field": "created", "id": "2", "settings": { "formattedKeyColumn": true } }]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "doc_count": 1, "key": 1000, "key_as_string": "1970-01-01T00:00:01" },
+                    { "doc_count": 2, "key": 2000, "key_as_string": "1970-01-01T00:00:02" }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 3)
+				So(table.Columns[0].Text, ShouldEqual, "created")
+				So(table.Columns[1].Text, ShouldEqual, "created formatted")
+				So(table.Rows[1], ShouldResemble, tsdb.RowValues{null.FloatFrom(2000), "1970-01-01T00:00:02", null.FloatFrom(2)})
+			})
+
+			Convey("Should keep the formatted column when the first parent has no key_as_string", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "terms", "field": "created", "id": "3", "settings": { "formattedKeyColumn": true } }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": "server1" },
+                    {
+                      "3": { "buckets": [{ "doc_count": 2, "key": 2000, "key_as_string": "1970-01-01T00:00:02" }] },
+                      "doc_count": 2,
+                      "key": "server2"
+                    }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 4)
+				So(table.Columns[1].Text, ShouldEqual, "created")
+				So(table.Columns[2].Text, ShouldEqual, "created formatted")
+				So(table.Rows, ShouldHaveLength, 2)
+				So(table.Rows[0], ShouldResemble, tsdb.RowValues{"server1", null.FloatFrom(1000), nil, null.FloatFrom(1)})
+				So(table.Rows[1], ShouldResemble, tsdb.RowValues{"server2", null.FloatFrom(2000), "1970-01-01T00:00:02", null.FloatFrom(2)})
+			})
+
+			Convey("Should not add the formatted key to series names", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "bytes", "id": "2", "settings": { "formattedKeyColumn": true } },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "3": { "buckets": [{ "doc_count": 1, "key": 1000 }] }, "doc_count": 1, "key": 10, "key_as_string": "10B" }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 1)
+				So(series[0].Name, ShouldEqual, "10B")
+				So(series[0].Tags, ShouldResemble, map[string]string{"bytes": "10B"})
+			})
+
+			Convey("Should leave the formatted column empty without key_as_string", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "histogram", "field": "bytes", "id": "2", "settings": { "formattedKeyColumn": true } }]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [{ "doc_count": 1, "key": 10 }, { "doc_count": 2, "key": 20 }]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				table := result.Results["A"].Tables[0]
+				So(table.Columns, ShouldHaveLength, 3)
+				So(table.Columns[1].Text, ShouldEqual, "bytes formatted")
+				So(table.Rows[0], ShouldResemble, tsdb.RowValues{null.FloatFrom(10), nil, null.FloatFrom(1)})
+			})
+		})
+
+		Convey("Weighted average with missing values", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [
+						{
+							"type": "weighted_avg",
+							"id": "1",
+							"settings": { "value": { "field": "grade", "missing": 2 }, "weight": { "field": "weight", "missing": 0 } }
+						},
+						{
+							"type": "weighted_avg",
+							"id": "3",
+							"settings": { "value": { "field": "grade" }, "weight": { "field": "weight", "missing": 1 } }
+						}
+					],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [{ "1": { "value": 2.5 }, "3": { "value": 3.5 }, "doc_count": 3, "key": 1000 }]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			queryRes := result.Results["A"]
+			So(queryRes.Series, ShouldHaveLength, 2)
+			So(queryRes.Series[0].Points[0][0].Float64, ShouldEqual, 2.5)
+
+			missing := queryRes.Meta.Get("weightedAvgMissing")
+			So(missing.GetPath("1", "value").MustFloat64(), ShouldEqual, 2)
+			So(missing.GetPath("1", "weight").MustFloat64(), ShouldEqual, 0)
+			So(missing.Get("3").MustMap(), ShouldHaveLength, 1)
+			So(missing.GetPath("3", "weight").MustFloat64(), ShouldEqual, 1)
+		})
+
+		Convey("Percentiles with differing buckets", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "percentiles", "field": "latency", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "1": { "values": { "50": 1 } }, "doc_count": 1, "key": 1000 },
+                  { "1": { "values": { "50": 2, "99": 20 } }, "doc_count": 2, "key": 2000 },
+                  { "doc_count": 0, "key": 3000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			series := result.Results["A"].Series
+			So(series, ShouldHaveLength, 2)
+			So(series[0].Name, ShouldEqual, "p50 latency")
+			So(series[1].Name, ShouldEqual, "p99 latency")
+			So(series[0].Points, ShouldHaveLength, 3)
+			So(series[1].Points, ShouldHaveLength, 3)
+			So(series[1].Points[0][0].Valid, ShouldBeFalse)
+			So(series[1].Points[1][0].Float64, ShouldEqual, 20)
+
+			series[0].Points[1][1] = null.FloatFrom(0)
+			series[0].Points = append(series[0].Points, tsdb.TimePoint{null.FloatFrom(3), null.FloatFrom(4000)})
+			So(series[1].Points, ShouldHaveLength, 3)
+			So(series[1].Points[1][1].Float64, ShouldEqual, 2000)
+		})
+
+		Convey("Percentiles without values", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  { "1": { "values": {} }, "doc_count": 0, "key": 1000 },
+                  { "1": { "values": {} }, "doc_count": 0, "key": 2000 }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+
+			Convey("Should return null series for the configured percents", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "percentiles", "field": "latency", "id": "1", "settings": { "percents": ["50", 99.9] } }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 2)
+				So(series[0].Name, ShouldEqual, "p50.0 latency")
+				So(series[1].Name, ShouldEqual, "p99.9 latency")
+				for _, s := range series {
+					So(s.Points, ShouldHaveLength, 2)
+					So(s.Points[0][0].Valid, ShouldBeFalse)
+					So(s.Points[1][0].Valid, ShouldBeFalse)
+				}
+			})
+
+			Convey("Should return null series for the default percents", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "percentiles", "field": "latency", "id": "1" }],
+						"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+					}`,
+				}
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, len(defaultPercents))
+				So(series[0].Name, ShouldEqual, "p1.0 latency")
+				So(series[len(series)-1].Name, ShouldEqual, "p99.0 latency")
+			})
+		})
+
+		Convey("Total series across terms", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [
+                  {
+                    "3": {
+                      "buckets": [
+                        { "1": { "value": 10 }, "doc_count": 1, "key": 1000 },
+                        { "1": { "value": 20 }, "doc_count": 2, "key": 2000 }
+                      ]
+                    },
+                    "doc_count": 3,
+                    "key": "server1"
+                  },
+                  {
+                    "3": {
+                      "buckets": [
+                        { "1": { "value": 30 }, "doc_count": 3, "key": 2000 },
+                        { "1": { "value": 40 }, "doc_count": 4, "key": 3000 }
+                      ]
+                    },
+                    "doc_count": 7,
+                    "key": "server2"
+                  }
+                ]
+              }
+            }
+          }
+        ]
+			}`
+			newTarget := func(totalSeries bool, metrics string) string {
+				return `{
+					"timeField": "@timestamp",
+					"totalSeries": ` + strconv.FormatBool(totalSeries) + `,
+					"metrics": ` + metrics + `,
+					"bucketAggs": [
+						{ "type": "terms", "field": "host", "id": "2" },
+						{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+					]
+				}`
+			}
+			countMetric := `[{ "type": "count", "id": "1" }]`
+
+			Convey("Should not add a total series by default", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": newTarget(false, countMetric)}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].Series, ShouldHaveLength, 2)
+			})
+
+			Convey("Should sum counts across terms per timestamp", func() {
+				rp, err := newResponseParserForTest(map[string]string{"A": newTarget(true, countMetric)}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 3)
+				So(series[0].Name, ShouldEqual, "server1")
+				So(series[1].Name, ShouldEqual, "server2")
+				So(series[2].Name, ShouldEqual, "Total")
+				So(series[2].Tags["host"], ShouldEqual, "Total")
+				So(series[2].Points, ShouldResemble, tsdb.TimeSeriesPoints{
+					{null.FloatFrom(1), null.FloatFrom(1000)},
+					{null.FloatFrom(5), null.FloatFrom(2000)},
+					{null.FloatFrom(4), null.FloatFrom(3000)},
+				})
+				So(series[0].Points[1][0].Float64, ShouldEqual, 2)
+			})
+
+			Convey("Should not sum averages", func() {
+				metrics := `[{ "type": "avg", "field": "latency", "id": "1" }]`
+				rp, err := newResponseParserForTest(map[string]string{"A": newTarget(true, metrics)}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+				So(result.Results["A"].Series, ShouldHaveLength, 2)
+			})
+
+			Convey("Should sum sums across terms", func() {
+				metrics := `[{ "type": "sum", "field": "bytes", "id": "1" }]`
+				rp, err := newResponseParserForTest(map[string]string{"A": newTarget(true, metrics)}, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				series := result.Results["A"].Series
+				So(series, ShouldHaveLength, 3)
+				So(series[2].Name, ShouldEqual, "Total")
+				So(series[2].Points, ShouldResemble, tsdb.TimeSeriesPoints{
+					{null.FloatFrom(10), null.FloatFrom(1000)},
+					{null.FloatFrom(50), null.FloatFrom(2000)},
+					{null.FloatFrom(40), null.FloatFrom(3000)},
+				})
+			})
+		})
+
+		Convey("Date histogram without metrics", func() {
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": [{ "doc_count": 3, "key": 1000 }, { "doc_count": 5, "key": 2000 }]
+              }
+            }
+          }
+        ]
+			}`
+
+			for _, tc := range []struct{ name, metrics string }{{"missing", ""}, {"empty", `"metrics": [],`}} {
+				metrics := tc.metrics
+				Convey("Should return a count series when metrics are "+tc.name, func() {
+					targets := map[string]string{
+						"A": `{
+							"timeField": "@timestamp",
+							` + metrics + `
+							"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+						}`,
+					}
+					rp, err := newResponseParserForTest(targets, response)
+					So(err, ShouldBeNil)
+					So(rp.Targets[0].Metrics, ShouldBeEmpty)
+					result, err := rp.getTimeSeries()
+					So(err, ShouldBeNil)
+
+					series := result.Results["A"].Series
+					So(series, ShouldHaveLength, 1)
+					So(series[0].Name, ShouldEqual, "Count")
+					So(series[0].Points, ShouldResemble, tsdb.TimeSeriesPoints{
+						{null.FloatFrom(3), null.FloatFrom(1000)},
+						{null.FloatFrom(5), null.FloatFrom(2000)},
+					})
+				})
+			}
+		})
+
+		Convey("Effective time range", func() {
+			Convey("Should span the timestamps of all series", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [
+							{ "type": "terms", "field": "host", "id": "2" },
+							{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+						]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": {
+                  "buckets": [
+                    { "3": { "buckets": [{ "doc_count": 1, "key": 2000 }, { "doc_count": 2, "key": 3000 }] }, "doc_count": 3, "key": "server1" },
+                    { "3": { "buckets": [{ "doc_count": 4, "key": 1000 }, { "doc_count": 5, "key": 2000 }] }, "doc_count": 9, "key": "server2" }
+                  ]
+                }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				timeRange := result.Results["A"].Meta.Get("effectiveTimeRange")
+				So(timeRange.Get("from").MustFloat64(), ShouldEqual, 1000)
+				So(timeRange.Get("to").MustFloat64(), ShouldEqual, 3000)
+			})
+
+			Convey("Should be skipped for tables without time", func() {
+				targets := map[string]string{
+					"A": `{
+						"timeField": "@timestamp",
+						"metrics": [{ "type": "count", "id": "1" }],
+						"bucketAggs": [{ "type": "terms", "field": "host", "id": "2" }]
+					}`,
+				}
+				response := `{
+          "responses": [
+            {
+              "aggregations": {
+                "2": { "buckets": [{ "doc_count": 3, "key": "server1" }] }
+              }
+            }
+          ]
+				}`
+				rp, err := newResponseParserForTest(targets, response)
+				So(err, ShouldBeNil)
+				result, err := rp.getTimeSeries()
+				So(err, ShouldBeNil)
+
+				_, ok := result.Results["A"].Meta.CheckGet("effectiveTimeRange")
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("Empty buckets", func() {
+			for _, empty := range []string{"[]", "{}"} {
+				empty := empty
+
+				Convey("Should return no series for nested buckets of "+empty, func() {
+					targets := map[string]string{
+						"A": `{
+							"timeField": "@timestamp",
+							"metrics": [{ "type": "count", "id": "1" }],
+							"bucketAggs": [
+								{ "type": "terms", "field": "host", "id": "2" },
+								{ "type": "date_histogram", "field": "@timestamp", "id": "3" }
+							]
+						}`,
+					}
+					response := `{
+            "responses": [
+              {
+                "aggregations": {
+                  "2": {
+                    "buckets": [{ "3": { "buckets": ` + empty + ` }, "doc_count": 0, "key": "server1" }]
+                  }
+                }
+              }
+            ]
+					}`
+					rp, err := newResponseParserForTest(targets, response)
+					So(err, ShouldBeNil)
+					So(rp.estimateSeriesCount(rp.Targets[0], rp.Responses[0]), ShouldEqual, 1)
+					result, err := rp.getTimeSeries()
+					So(err, ShouldBeNil)
+
+					queryRes := result.Results["A"]
+					So(queryRes.Series, ShouldHaveLength, 1)
+					So(queryRes.Series[0].Points, ShouldHaveLength, 0)
+					So(queryRes.Tables, ShouldHaveLength, 0)
+				})
+
+				Convey("Should return no rows for terminal buckets of "+empty, func() {
+					targets := map[string]string{
+						"A": `{
+							"timeField": "@timestamp",
+							"metrics": [{ "type": "count", "id": "1" }],
+							"bucketAggs": [
+								{ "type": "terms", "field": "host", "id": "2" },
+								{ "type": "terms", "field": "level", "id": "3" }
+							]
+						}`,
+					}
+					response := `{
+            "responses": [
+              {
+                "aggregations": {
+                  "2": { "buckets": ` + empty + ` }
+                }
+              }
+            ]
+					}`
+					rp, err := newResponseParserForTest(targets, response)
+					So(err, ShouldBeNil)
+					So(rp.estimateSeriesCount(rp.Targets[0], rp.Responses[0]), ShouldEqual, 0)
+					result, err := rp.getTimeSeries()
+					So(err, ShouldBeNil)
+
+					queryRes := result.Results["A"]
+					So(queryRes.Series, ShouldHaveLength, 0)
+					So(queryRes.Tables, ShouldHaveLength, 0)
+				})
+			}
+		})
+
+		Convey("Keyed date histogram", func() {
+			targets := map[string]string{
+				"A": `{
+					"timeField": "@timestamp",
+					"metrics": [{ "type": "count", "id": "1" }],
+					"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }]
+				}`,
+			}
+			response := `{
+        "responses": [
+          {
+            "aggregations": {
+              "2": {
+                "buckets": {
+                  "b": { "doc_count": 2, "key": 2000 },
+                  "a": { "doc_count": 1, "key": 1000 }
+                }
+              }
+            }
+          }
+        ]
+			}`
+			rp, err := newResponseParserForTest(targets, response)
+			So(err, ShouldBeNil)
+			result, err := rp.getTimeSeries()
+			So(err, ShouldBeNil)
+
+			series := result.Results["A"].Series
+			So(series, ShouldHaveLength, 1)
+			So(series[0].Points, ShouldResemble, tsdb.TimeSeriesPoints{
+				{null.FloatFrom(1), null.FloatFrom(1000)},
+				{null.FloatFrom(2), null.FloatFrom(2000)},
+			})
+		})
+
 		// Convey("Raw documents query", func() {
 		// 	targets := map[string]string{
 		// 		"A": `{
@@ -921,27 +6106,34 @@ func TestResponseParser(t *testing.T) {
 }
 
 func newResponseParserForTest(tsdbQueries map[string]string, responseBody string) (*responseParser, error) {
-	from := time.Date(2018, 5, 15, 17, 50, 0, 0, time.UTC)
-	to := time.Date(2018, 5, 15, 17, 55, 0, 0, time.UTC)
-	fromStr := fmt.Sprintf("%d", from.UnixNano()/int64(time.Millisecond))
-	toStr := fmt.Sprintf("%d", to.UnixNano()/int64(time.Millisecond))
-	tsdbQuery := &tsdb.TsdbQuery{
-		Queries:   []*tsdb.Query{},
-		TimeRange: tsdb.NewTimeRange(fromStr, toStr),
-	}
-
+	queries := []*tsdb.Query{}
 	for refID, tsdbQueryBody := range tsdbQueries {
 		tsdbQueryJSON, err := simplejson.NewJson([]byte(tsdbQueryBody))
 		if err != nil {
 			return nil, err
 		}
 
-		tsdbQuery.Queries = append(tsdbQuery.Queries, &tsdb.Query{
+		queries = append(queries, &tsdb.Query{
 			Model: tsdbQueryJSON,
 			RefId: refID,
 		})
 	}
 
+	return newResponseParserForQueriesForTest(queries, responseBody)
+}
+
+// newResponseParserForQueriesForTest is like newResponseParserForTest but
+// keeps the order of the queries, which may share a ref id.
+func newResponseParserForQueriesForTest(queries []*tsdb.Query, responseBody string) (*responseParser, error) {
+	from := time.Date(2018, 5, 15, 17, 50, 0, 0, time.UTC)
+	to := time.Date(2018, 5, 15, 17, 55, 0, 0, time.UTC)
+	fromStr := fmt.Sprintf("%d", from.UnixNano()/int64(time.Millisecond))
+	toStr := fmt.Sprintf("%d", to.UnixNano()/int64(time.Millisecond))
+	tsdbQuery := &tsdb.TsdbQuery{
+		Queries:   queries,
+		TimeRange: tsdb.NewTimeRange(fromStr, toStr),
+	}
+
 	var response es.MultiSearchResponse
 	err := json.Unmarshal([]byte(responseBody), &response)
 	if err != nil {
@@ -949,10 +6141,10 @@ func newResponseParserForTest(tsdbQueries map[string]string, responseBody string
 	}
 
 	tsQueryParser := newTimeSeriesQueryParser()
-	queries, err := tsQueryParser.parse(tsdbQuery)
+	targets, err := tsQueryParser.parse(tsdbQuery)
 	if err != nil {
 		return nil, err
 	}
 
-	return newResponseParser(response.Responses, queries, nil), nil
+	return newResponseParser(response.Responses, targets, nil, false), nil
 }
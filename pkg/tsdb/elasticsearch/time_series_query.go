@@ -13,6 +13,9 @@ type timeSeriesQuery struct {
 	client             es.Client
 	tsdbQuery          *tsdb.TsdbQuery
 	intervalCalculator tsdb.IntervalCalculator
+	// failFast fails the whole request on the first error response or parse
+	// error instead of recording an error result per target
+	failFast bool
 }
 
 var newTimeSeriesQuery = func(client es.Client, tsdbQuery *tsdb.TsdbQuery, intervalCalculator tsdb.IntervalCalculator) *timeSeriesQuery {
@@ -47,6 +50,9 @@ func (e *timeSeriesQuery) execute() (*tsdb.Response, error) {
 
 		b := ms.Search(interval)
 		b.Size(0)
+		if q.Profile {
+			b.Profile()
+		}
 		filters := b.Query().Bool().Filter()
 		filters.AddDateRangeFilter(e.client.GetTimeField(), to, from, es.DateFormatEpochMS)
 
@@ -163,7 +169,7 @@ func (e *timeSeriesQuery) execute() (*tsdb.Response, error) {
 		return nil, err
 	}
 
-	rp := newResponseParser(res.Responses, queries, res.DebugInfo)
+	rp := newResponseParser(res.Responses, queries, res.DebugInfo, e.failFast)
 	return rp.getTimeSeries()
 }
 
@@ -182,6 +188,10 @@ func addDateHistogramAgg(aggBuilder es.AggBuilder, bucketAgg *BucketAgg, timeFro
 			a.Offset = offset
 		}
 
+		if timeZone, err := bucketAgg.Settings.Get("time_zone").String(); err == nil {
+			a.TimeZone = timeZone
+		}
+
 		if missing, err := bucketAgg.Settings.Get("missing").String(); err == nil {
 			a.Missing = &missing
 		}
@@ -229,6 +239,14 @@ func addTermsAgg(aggBuilder es.AggBuilder, bucketAgg *BucketAgg, metrics []*Metr
 		if missing, err := bucketAgg.Settings.Get("missing").String(); err == nil {
 			a.Missing = &missing
 		}
+		if include, ok := bucketAgg.Settings.CheckGet("include"); ok {
+			a.Include = include.Interface()
+		}
+		if exclude, ok := bucketAgg.Settings.CheckGet("exclude"); ok {
+			a.Exclude = exclude.Interface()
+		}
+		a.ExecutionHint = bucketAgg.Settings.Get("execution_hint").MustString()
+		a.CollectMode = bucketAgg.Settings.Get("collect_mode").MustString()
 
 		if orderBy, err := bucketAgg.Settings.Get("orderBy").String(); err == nil {
 			a.Order[orderBy] = bucketAgg.Settings.Get("order").MustString("desc")
@@ -304,22 +322,74 @@ func (p *timeSeriesQueryParser) parse(tsdbQuery *tsdb.TsdbQuery) ([]*Query, erro
 			return nil, err
 		}
 		alias := model.Get("alias").MustString("")
+		output := model.Get("output").MustString("")
+		rawBuckets := model.Get("rawBuckets").MustBool(false)
+		missingCountAs := model.Get("missingCountAs").MustString("")
+		profile := model.Get("profile").MustBool(false)
+		dropAllNullSeries := model.Get("dropAllNullSeries").MustBool(false)
+		timeColumn := model.Get("timeColumn").MustString("")
+		strictTermAccuracy := model.Get("strictTermAccuracy").MustBool(false)
+		maxDocCountError := model.Get("maxDocCountError").MustInt64(0)
+		splitByIndex := model.Get("splitByIndex").MustBool(false)
+		alignInterval := model.Get("alignInterval").MustString("")
+		significantDigits := model.Get("significantDigits").MustInt(0)
+		timeOrder := model.Get("timeOrder").MustString("")
+		columnsMetric := model.Get("columnsMetric").MustString("")
+		maxRows := model.Get("maxRows").MustInt(0)
+		maxSeries := model.Get("maxSeries").MustInt(0)
+		lenientParsing := model.Get("lenientParsing").MustBool(false)
+		coalesceSeries := model.Get("coalesceSeries").MustString("")
+		totalSeries := model.Get("totalSeries").MustBool(false)
+		if splitByIndex && len(bucketAggs) > 0 {
+			bucketAggs = append([]*BucketAgg{newIndexTermsAgg()}, bucketAggs...)
+		}
 		interval := strconv.FormatInt(q.IntervalMs, 10) + "ms"
 
 		queries = append(queries, &Query{
-			TimeField:  timeField,
-			RawQuery:   rawQuery,
-			BucketAggs: bucketAggs,
-			Metrics:    metrics,
-			Alias:      alias,
-			Interval:   interval,
-			RefID:      q.RefId,
+			TimeField:          timeField,
+			RawQuery:           rawQuery,
+			BucketAggs:         bucketAggs,
+			Metrics:            metrics,
+			Alias:              alias,
+			Output:             output,
+			RawBuckets:         rawBuckets,
+			MissingCountAs:     missingCountAs,
+			Profile:            profile,
+			DropAllNullSeries:  dropAllNullSeries,
+			TimeColumn:         timeColumn,
+			StrictTermAccuracy: strictTermAccuracy,
+			MaxDocCountError:   maxDocCountError,
+			SplitByIndex:       splitByIndex,
+			AlignInterval:      alignInterval,
+			SignificantDigits:  significantDigits,
+			TimeOrder:          timeOrder,
+			ColumnsMetric:      columnsMetric,
+			MaxRows:            maxRows,
+			MaxSeries:          maxSeries,
+			LenientParsing:     lenientParsing,
+			CoalesceSeries:     coalesceSeries,
+			TotalSeries:        totalSeries,
+			Interval:           interval,
+			RefID:              q.RefId,
 		})
 	}
 
 	return queries, nil
 }
 
+// newIndexTermsAgg returns the terms aggregation on _index added in front of
+// the bucket aggregations of targets split by index. The _index of a document
+// is its concrete index, so aliases and index patterns are split into the
+// indices they resolve to.
+func newIndexTermsAgg() *BucketAgg {
+	return &BucketAgg{
+		Type:     termsType,
+		ID:       indexAggID,
+		Field:    indexField,
+		Settings: simplejson.New(),
+	}
+}
+
 func (p *timeSeriesQueryParser) parseBucketAggs(model *simplejson.Json) ([]*BucketAgg, error) {
 	var err error
 	var result []*BucketAgg
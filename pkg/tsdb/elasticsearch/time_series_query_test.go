@@ -181,6 +181,95 @@ func TestExecuteTimeSeriesQuery(t *testing.T) {
 			So(termsAgg.Order["_key"], ShouldEqual, "asc")
 		})
 
+		Convey("With term agg and include/exclude filters", func() {
+			c := newFakeClient(5)
+			_, err := executeTsdbQuery(c, `{
+				"timeField": "@timestamp",
+				"bucketAggs": [
+					{
+						"type": "terms",
+						"field": "@host",
+						"id": "2",
+						"settings": { "include": "server-.*", "exclude": ["server-3"] }
+					}
+				],
+				"metrics": [{"type": "count", "id": "1" }]
+			}`, from, to, 15*time.Second)
+			So(err, ShouldBeNil)
+			sr := c.multisearchRequests[0].Requests[0]
+
+			termsAgg := sr.Aggs[0].Aggregation.Aggregation.(*es.TermsAggregation)
+			So(termsAgg.Include, ShouldEqual, "server-.*")
+			So(termsAgg.Exclude, ShouldResemble, []interface{}{"server-3"})
+		})
+
+		Convey("With term agg and execution hint", func() {
+			c := newFakeClient(5)
+			_, err := executeTsdbQuery(c, `{
+				"timeField": "@timestamp",
+				"bucketAggs": [
+					{ "type": "terms", "field": "@host", "id": "2", "settings": { "execution_hint": "map" } }
+				],
+				"metrics": [{"type": "count", "id": "1" }]
+			}`, from, to, 15*time.Second)
+			So(err, ShouldBeNil)
+			sr := c.multisearchRequests[0].Requests[0]
+
+			termsAgg := sr.Aggs[0].Aggregation.Aggregation.(*es.TermsAggregation)
+			So(termsAgg.ExecutionHint, ShouldEqual, "map")
+		})
+
+		Convey("With term agg and collect mode", func() {
+			c := newFakeClient(5)
+			_, err := executeTsdbQuery(c, `{
+				"timeField": "@timestamp",
+				"bucketAggs": [
+					{ "type": "terms", "field": "@host", "id": "2", "settings": { "collect_mode": "breadth_first" } }
+				],
+				"metrics": [{"type": "count", "id": "1" }]
+			}`, from, to, 15*time.Second)
+			So(err, ShouldBeNil)
+			sr := c.multisearchRequests[0].Requests[0]
+
+			termsAgg := sr.Aggs[0].Aggregation.Aggregation.(*es.TermsAggregation)
+			So(termsAgg.CollectMode, ShouldEqual, "breadth_first")
+		})
+
+		Convey("With split by index", func() {
+			c := newFakeClient(5)
+			_, err := executeTsdbQuery(c, `{
+				"timeField": "@timestamp",
+				"splitByIndex": true,
+				"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }],
+				"metrics": [{"type": "count", "id": "1" }]
+			}`, from, to, 15*time.Second)
+			So(err, ShouldBeNil)
+			sr := c.multisearchRequests[0].Requests[0]
+
+			firstLevel := sr.Aggs[0]
+			So(firstLevel.Key, ShouldEqual, "index")
+			termsAgg := firstLevel.Aggregation.Aggregation.(*es.TermsAggregation)
+			So(termsAgg.Field, ShouldEqual, "_index")
+			So(termsAgg.Size, ShouldEqual, 500)
+
+			secondLevel := firstLevel.Aggregation.Aggs[0]
+			So(secondLevel.Key, ShouldEqual, "2")
+			So(secondLevel.Aggregation.Type, ShouldEqual, "date_histogram")
+		})
+
+		Convey("With profile enabled", func() {
+			c := newFakeClient(5)
+			_, err := executeTsdbQuery(c, `{
+				"timeField": "@timestamp",
+				"profile": true,
+				"bucketAggs": [{ "type": "date_histogram", "field": "@timestamp", "id": "2" }],
+				"metrics": [{"type": "count", "id": "1" }]
+			}`, from, to, 15*time.Second)
+			So(err, ShouldBeNil)
+			sr := c.multisearchRequests[0].Requests[0]
+			So(sr.CustomProps["profile"], ShouldEqual, true)
+		})
+
 		Convey("With metric percentiles", func() {
 			c := newFakeClient(5)
 			_, err := executeTsdbQuery(c, `{
@@ -328,6 +417,49 @@ func TestExecuteTimeSeriesQuery(t *testing.T) {
 			So(hAgg.MinDocCount, ShouldEqual, 2)
 		})
 
+		Convey("With date histogram agg and negative offset", func() {
+			c := newFakeClient(5)
+			_, err := executeTsdbQuery(c, `{
+				"timeField": "@timestamp",
+				"bucketAggs": [
+					{
+						"id": "2",
+						"type": "date_histogram",
+						"field": "@timestamp",
+						"settings": { "interval": "10s", "offset": "-3s" }
+					}
+				],
+				"metrics": [{"type": "count", "id": "1" }]
+			}`, from, to, 15*time.Second)
+			So(err, ShouldBeNil)
+			sr := c.multisearchRequests[0].Requests[0]
+
+			hAgg := sr.Aggs[0].Aggregation.Aggregation.(*es.DateHistogramAgg)
+			So(hAgg.Interval, ShouldEqual, "10s")
+			So(hAgg.Offset, ShouldEqual, "-3s")
+		})
+
+		Convey("With date histogram agg and time zone", func() {
+			c := newFakeClient(5)
+			_, err := executeTsdbQuery(c, `{
+				"timeField": "@timestamp",
+				"bucketAggs": [
+					{
+						"id": "2",
+						"type": "date_histogram",
+						"field": "@timestamp",
+						"settings": { "interval": "1d", "time_zone": "Europe/Berlin" }
+					}
+				],
+				"metrics": [{"type": "count", "id": "1" }]
+			}`, from, to, 15*time.Second)
+			So(err, ShouldBeNil)
+			sr := c.multisearchRequests[0].Requests[0]
+
+			hAgg := sr.Aggs[0].Aggregation.Aggregation.(*es.DateHistogramAgg)
+			So(hAgg.TimeZone, ShouldEqual, "Europe/Berlin")
+		})
+
 		Convey("With histogram agg", func() {
 			c := newFakeClient(5)
 			_, err := executeTsdbQuery(c, `{
@@ -614,6 +746,38 @@ func TestExecuteTimeSeriesQuery(t *testing.T) {
 				"var1": "_count",
 			})
 		})
+
+		Convey("With bucket_selector", func() {
+			c := newFakeClient(5)
+			_, err := executeTsdbQuery(c, `{
+				"timeField": "@timestamp",
+				"bucketAggs": [
+					{ "type": "date_histogram", "field": "@timestamp", "id": "4" }
+				],
+				"metrics": [
+					{ "id": "3", "type": "count", "field": "select field" },
+					{
+						"id": "2",
+						"type": "bucket_selector",
+						"pipelineVariables": [
+							{ "name": "var1", "pipelineAgg": "3" }
+						],
+						"settings": { "script": "params.var1 > 10" }
+					}
+				]
+			}`, from, to, 15*time.Second)
+			So(err, ShouldBeNil)
+			sr := c.multisearchRequests[0].Requests[0]
+
+			firstLevel := sr.Aggs[0]
+			bucketSelectorAgg := firstLevel.Aggregation.Aggs[0]
+			So(bucketSelectorAgg.Key, ShouldEqual, "2")
+			So(bucketSelectorAgg.Aggregation.Type, ShouldEqual, "bucket_selector")
+			plAgg := bucketSelectorAgg.Aggregation.Aggregation.(*es.PipelineAggregation)
+			So(plAgg.BucketPath.(map[string]interface{}), ShouldResemble, map[string]interface{}{
+				"var1": "_count",
+			})
+		})
 	})
 }
 